@@ -17,9 +17,19 @@ func init() {
 }
 
 func main() {
+	ParseFlag()
+
+	if *FlagVersion {
+		fmt.Println(VERSION)
+		return
+	}
+
 	dockerBinPath := path.Join(DockerDir, DockerBinaryName)
 	dockerNewBinPath := path.Join(DockerDir, DockerNewBinaryName)
 	dockerNewBinSigPath := path.Join(DockerDir, DockerNewBinarySigName)
+	dockerPrevBinPath := path.Join(DockerDir, DockerPrevBinaryName)
+	dockerRollbackPath := path.Join(DockerDir, DockerRollbackName)
+	dockerUpgradeNowPath := path.Join(DockerDir, DockerUpgradeNowName)
 	configFilePath := path.Join(TutumHome, ConfigFileName)
 	keyFilePath := path.Join(TutumHome, KeyFileName)
 	certFilePath := path.Join(TutumHome, CertFileName)
@@ -27,18 +37,15 @@ func main() {
 	ngrokPath := path.Join(DockerDir, NgrokBinaryName)
 	ngrokLogPath := path.Join(LogDir, NgrokLogName)
 	ngrokConfPath := path.Join(TutumHome, NgrokConfName)
+	metricsFilePath := path.Join(TutumHome, MetricsFileName)
 
-	_ = os.MkdirAll(TutumHome, 0755)
-	_ = os.MkdirAll(DockerDir, 0755)
-	_ = os.MkdirAll(LogDir, 0755)
+	CreateDirs()
 
-	ParseFlag()
-
-	if *FlagVersion {
-		fmt.Println(VERSION)
-		return
-	}
 	SetLogger(path.Join(LogDir, TutumLogFileName))
+	DockerCommand(dockerBinPath, dockerNewBinPath, dockerPrevBinPath, dockerRollbackPath, dockerUpgradeNowPath)
+	PreflightCommand(configFilePath)
+	MetricsCommand(metricsFilePath)
+	DockerActivatedSockets = ActivatedSockets()
 	Logger.Print("Running tutum-agent: version ", VERSION)
 	CreatePidFile(TutumPidFile)
 
@@ -79,6 +86,7 @@ func main() {
 			os.RemoveAll(keyFilePath)
 			os.RemoveAll(certFilePath)
 			os.RemoveAll(caFilePath)
+			RemoveRegistryCredentials()
 
 			Logger.Printf("Registering in Tutum via POST: %s", regUrl)
 			PostToTutum(regUrl, caFilePath, configFilePath)
@@ -98,12 +106,39 @@ func main() {
 		Logger.Fatalln(err)
 	}
 
-	DownloadDocker(DockerBinaryURL, dockerBinPath)
+	if Conf.DockerExternal {
+		Logger.Println("Using the docker engine managed by the init system")
+		if err := ConfigureExternalDocker(keyFilePath, certFilePath, caFilePath); err != nil {
+			SendError(err, "Failed to configure external docker", nil)
+			Logger.Println("Cannot configure external docker:", err)
+		}
+	} else {
+		DownloadDocker(DockerBinaryURL, dockerBinPath)
+		Docker = NewDockerEngine(dockerBinPath, keyFilePath, certFilePath, caFilePath)
+		if Conf.DockerCgroup != "" {
+			DockerCgroupManager = NewDockerCgroup(Conf.DockerCgroup, GetCgroupLimits())
+		}
+	}
 	HandleSig()
-	syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), RenicePriority)
+	if IsUnprivileged() {
+		Logger.Println("Running without root privileges, skip renicing")
+	} else {
+		syscall.Setpriority(syscall.PRIO_PROCESS, os.Getpid(), RenicePriority)
+	}
 
-	Logger.Println("Initializing docker daemon")
-	StartDocker(dockerBinPath, keyFilePath, certFilePath, caFilePath)
+	if !Conf.DockerExternal {
+		RunPreflight()
+		Logger.Println("Initializing docker daemon")
+		Docker.Start()
+		go RestoreSavedContainers(path.Join(TutumHome, ContainerSnapshotName))
+		go NewDockerHealthChecker(Docker).Run()
+		go PollDockerUpgrades(dockerBinPath, dockerNewBinPath, dockerNewBinSigPath)
+	}
+
+	Logger.Println("Collecting node and container metrics")
+	go NewMetricsCollector(metricsFilePath).Run()
+	go ShipContainerLogs()
+	go CollectGarbage()
 
 	if !*FlagStandalone {
 		if *FlagSkipNatTunnel {
@@ -117,21 +152,22 @@ func main() {
 	if !*FlagStandalone {
 		Logger.Println("Verifying the registration with Tutum")
 		go VerifyRegistration(regUrl)
+
+		Logger.Println("Syncing registry credentials with Tutum")
+		go PollRegistryCredentials(regUrl)
+
+		Logger.Println("Forwarding docker events to Tutum")
+		go ForwardDockerEvents(path.Join(TutumHome, EventsBufferName))
 	}
 
 	Logger.Println("Docker server started. Entering maintenance loop")
 	for {
 		time.Sleep(HeartBeatInterval * time.Second)
-		UpdateDocker(dockerBinPath, dockerNewBinPath, dockerNewBinSigPath, keyFilePath, certFilePath, caFilePath)
-
-		// try to restart docker daemon if it dies somehow
-		if DockerProcess == nil {
-			time.Sleep(HeartBeatInterval * time.Second)
-			if DockerProcess == nil && ScheduleToTerminateDocker == false {
-				Logger.Println("Respawning docker daemon")
-				StartDocker(dockerBinPath, keyFilePath, certFilePath, caFilePath)
-			}
+		if Conf.DockerExternal {
+			continue
 		}
+		UpdateDocker(Docker, dockerNewBinPath, dockerNewBinSigPath, dockerUpgradeNowPath)
+		RollbackDockerIfRequested(Docker, dockerRollbackPath)
 	}
 }
 
@@ -174,4 +210,8 @@ func PrepareFiles(configFilePath, dockerBinPath, keyFilePath, certFilePath strin
 		Logger.Printf("Override 'DockerOpts' from command line flag: %s\n", *FlagDockerOpts)
 		Conf.DockerOpts = *FlagDockerOpts
 	}
+	if *FlagExternalDocker {
+		Logger.Println("Override 'DockerExternal' from command line flag: true")
+		Conf.DockerExternal = true
+	}
 }
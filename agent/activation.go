@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// ActivatedSockets returns the sockets passed by systemd socket activation,
+// or nil if the agent was not socket-activated. The sockets are not
+// inherited by other children, and the environment variables are cleared.
+func ActivatedSockets() []*os.File {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	n, names, err := parseListenFds(os.Getpid(), os.Getenv)
+	if err != nil {
+		Logger.Println("Ignoring socket activation:", err)
+		return nil
+	}
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	if len(files) > 0 {
+		Logger.Printf("Socket-activated with %d sockets, passing them to docker", len(files))
+	}
+	return files
+}
+
+// parseListenFds returns the number of sockets passed to pid and their
+// names, from LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+func parseListenFds(pid int, getenv func(string) string) (int, []string, error) {
+	if getenv("LISTEN_FDS") == "" {
+		return 0, nil, nil
+	}
+	listenPid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid LISTEN_PID %q", getenv("LISTEN_PID"))
+	}
+	if listenPid != pid {
+		return 0, nil, fmt.Errorf("LISTEN_PID %d is not the agent (%d)", listenPid, pid)
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdNames := getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	return n, names, nil
+}
+
+// activatedCommand runs bin in env with the activated sockets, as systemd
+// would: from fd 3, with LISTEN_FDS set and LISTEN_PID set to its own pid,
+// which is only known once forked, hence the shell exec'ing bin
+func activatedCommand(sockets []*os.File, env []string, bin string, args ...string) *exec.Cmd {
+	cmd := exec.Command("/bin/sh", append([]string{"-c", `LISTEN_PID=$$ exec "$0" "$@"`, bin}, args...)...)
+	cmd.ExtraFiles = sockets
+	var names []string
+	for _, socket := range sockets {
+		names = append(names, socket.Name())
+	}
+	cmd.Env = append(env, "LISTEN_FDS="+strconv.Itoa(len(sockets)), "LISTEN_FDNAMES="+strings.Join(names, ":"))
+	return cmd
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseListenFds(t *testing.T) {
+	tests := []struct {
+		env   map[string]string
+		n     int
+		names []string
+		err   bool
+	}{
+		{map[string]string{}, 0, nil, false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}, 1, nil, false},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "docker:docker-tcp"}, 2, []string{"docker", "docker-tcp"}, false},
+		{map[string]string{"LISTEN_PID": "43", "LISTEN_FDS": "1"}, 0, nil, true},
+		{map[string]string{"LISTEN_FDS": "1"}, 0, nil, true},
+		{map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "x"}, 0, nil, true},
+	}
+	for _, test := range tests {
+		getenv := func(key string) string { return test.env[key] }
+		n, names, err := parseListenFds(42, getenv)
+		if (err != nil) != test.err || n != test.n || strings.Join(names, ":") != strings.Join(test.names, ":") {
+			t.Errorf("%v: unexpected %d %v %v", test.env, n, names, err)
+		}
+	}
+}
+
+func TestActivatedCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "activation-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	socket, err := l.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	// the command checks that it got the socket on fd 3 and its own pid
+	cmd := activatedCommand([]*os.File{socket}, os.Environ(), "sh", "-c",
+		`test -e /proc/$$/fd/3 && echo $LISTEN_PID $$ $LISTEN_FDS`)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 || fields[0] != fields[1] || fields[2] != "1" {
+		t.Fatalf("Unexpected activation environment %q", out)
+	}
+	if pid, _ := strconv.Atoi(fields[0]); pid != cmd.Process.Pid {
+		t.Fatalf("Expected LISTEN_PID to be %d, got %s", cmd.Process.Pid, fields[0])
+	}
+}
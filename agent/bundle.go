@@ -0,0 +1,326 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// DockerBundleBinaries are the binaries shipped in the docker .tgz bundles,
+// with the names used before and after containerd was split out
+var DockerBundleBinaries = []string{
+	"docker",
+	"dockerd",
+	"docker-proxy",
+	"docker-init",
+	"containerd",
+	"containerd-shim",
+	"containerd-shim-runc-v2",
+	"ctr",
+	"runc",
+	"docker-containerd",
+	"docker-containerd-shim",
+	"docker-containerd-ctr",
+	"docker-runc",
+}
+
+func isDockerBundleBinary(name string) bool {
+	for _, binary := range DockerBundleBinaries {
+		if name == binary {
+			return true
+		}
+	}
+	return false
+}
+
+// isDockerBundle tells a gzipped bundle from a single docker binary
+func isDockerBundle(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// extractDockerBundle extracts the known binaries of a docker .tgz bundle
+// into stagingDir, whatever their directory in the archive, and returns
+// their names
+func extractDockerBundle(data []byte, stagingDir string) ([]string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := path.Base(hdr.Name)
+		if !isDockerBundleBinary(name) {
+			Logger.Println("Skipping unknown file in docker bundle:", hdr.Name)
+			continue
+		}
+		f, err := os.OpenFile(path.Join(stagingDir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no docker binary found in the bundle")
+	}
+	for _, name := range names {
+		if name == DockerBinaryName {
+			return names, nil
+		}
+	}
+	return nil, errors.New("no docker client found in the bundle")
+}
+
+// Docker is installed in dir as one directory per version under versions/,
+// with the current and previous symlinks pointing to the running version and
+// to the one used before the last upgrade. Each binary in dir is a symlink
+// to current/<binary>, and <binary>.prev to previous/<binary>, so that
+// switching versions is an atomic rename of the current symlink.
+const (
+	dockerVersionsDirName = "versions"
+	dockerCurrentLinkName = "current"
+	dockerPrevLinkName    = "previous"
+)
+
+// installDockerBundle installs the binaries of a docker .tgz bundle into
+// dir. The whole bundle is extracted in a new version directory before the
+// installed version is switched, so that a broken archive leaves the
+// installed docker untouched. When keepPrev is set, the installed version
+// is kept for rollbacks.
+func installDockerBundle(data []byte, dir string, keepPrev bool) error {
+	version, err := newDockerVersionDir(dir)
+	if err != nil {
+		return err
+	}
+	names, err := extractDockerBundle(data, version)
+	if err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+	if err := switchDockerVersion(dir, version, keepPrev); err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+	Logger.Printf("Installed docker bundle in %s: %v", version, names)
+	return nil
+}
+
+// installDockerFile installs a downloaded single docker binary or bundle
+func installDockerFile(file, dockerBinPath string, keepPrev bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(dockerBinPath)
+	if isDockerBundle(data) {
+		if err := installDockerBundle(data, dir, keepPrev); err != nil {
+			return err
+		}
+		return os.RemoveAll(file)
+	}
+	version, err := newDockerVersionDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(file, 0755); err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+	if err := os.Rename(file, path.Join(version, DockerBinaryName)); err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+	if err := switchDockerVersion(dir, version, keepPrev); err != nil {
+		os.RemoveAll(version)
+		return err
+	}
+	return nil
+}
+
+// newDockerVersionDir creates an empty version directory in dir
+func newDockerVersionDir(dir string) (string, error) {
+	if err := migrateDockerDir(dir); err != nil {
+		return "", err
+	}
+	versions := path.Join(dir, dockerVersionsDirName)
+	if err := os.MkdirAll(versions, 0755); err != nil {
+		return "", err
+	}
+	version, err := ioutil.TempDir(versions, "docker-")
+	if err != nil {
+		return "", err
+	}
+	return version, os.Chmod(version, 0755)
+}
+
+// switchDockerVersion makes version the current docker, keeping the current
+// one as the previous docker if keepPrev is set, and removes the versions
+// no longer used
+func switchDockerVersion(dir, version string, keepPrev bool) error {
+	if keepPrev {
+		if current, err := os.Readlink(path.Join(dir, dockerCurrentLinkName)); err == nil {
+			if err := replaceSymlink(current, path.Join(dir, dockerPrevLinkName)); err != nil {
+				return err
+			}
+		}
+	}
+	target := path.Join(dockerVersionsDirName, path.Base(version))
+	if err := replaceSymlink(target, path.Join(dir, dockerCurrentLinkName)); err != nil {
+		return err
+	}
+	return refreshDockerLinks(dir)
+}
+
+// swapDockerBinaries swaps the current docker with the one kept by the last
+// upgrade, so that swapping twice restores the original installation
+func swapDockerBinaries(dir string) error {
+	if err := migrateDockerDir(dir); err != nil {
+		return err
+	}
+	current, err := os.Readlink(path.Join(dir, dockerCurrentLinkName))
+	if err != nil {
+		return err
+	}
+	prev, err := os.Readlink(path.Join(dir, dockerPrevLinkName))
+	if err != nil {
+		return err
+	}
+	if err := replaceSymlink(prev, path.Join(dir, dockerCurrentLinkName)); err != nil {
+		return err
+	}
+	if err := replaceSymlink(current, path.Join(dir, dockerPrevLinkName)); err != nil {
+		return err
+	}
+	return refreshDockerLinks(dir)
+}
+
+// refreshDockerLinks points the binaries of dir to the ones of the current
+// and previous versions, and removes the versions no longer used
+func refreshDockerLinks(dir string) error {
+	for _, link := range []struct{ version, suffix string }{
+		{dockerCurrentLinkName, ""},
+		{dockerPrevLinkName, ".prev"},
+	} {
+		for _, name := range DockerBundleBinaries {
+			target := path.Join(link.version, name)
+			if utils.FileExist(path.Join(dir, target)) {
+				if err := replaceSymlink(target, path.Join(dir, name+link.suffix)); err != nil {
+					return err
+				}
+			} else {
+				os.RemoveAll(path.Join(dir, name+link.suffix))
+			}
+		}
+	}
+
+	used := map[string]bool{}
+	for _, link := range []string{dockerCurrentLinkName, dockerPrevLinkName} {
+		if target, err := os.Readlink(path.Join(dir, link)); err == nil {
+			used[path.Base(target)] = true
+		}
+	}
+	versions := path.Join(dir, dockerVersionsDirName)
+	entries, err := ioutil.ReadDir(versions)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			os.RemoveAll(path.Join(versions, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// migrateDockerDir moves the binaries installed in dir by older agents, and
+// the .prev ones kept for rollbacks, into version directories
+func migrateDockerDir(dir string) error {
+	migrated := false
+	for _, link := range []struct{ version, suffix string }{
+		{dockerCurrentLinkName, ""},
+		{dockerPrevLinkName, ".prev"},
+	} {
+		var names []string
+		for _, name := range DockerBundleBinaries {
+			if info, err := os.Lstat(path.Join(dir, name+link.suffix)); err == nil && info.Mode().IsRegular() {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		versions := path.Join(dir, dockerVersionsDirName)
+		if err := os.MkdirAll(versions, 0755); err != nil {
+			return err
+		}
+		version, err := ioutil.TempDir(versions, "docker-")
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(version, 0755); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := os.Rename(path.Join(dir, name+link.suffix), path.Join(version, name)); err != nil {
+				return err
+			}
+		}
+		target := path.Join(dockerVersionsDirName, path.Base(version))
+		if err := replaceSymlink(target, path.Join(dir, link.version)); err != nil {
+			return err
+		}
+		Logger.Printf("Moved docker binaries %v to %s", names, version)
+		migrated = true
+	}
+	if migrated {
+		return refreshDockerLinks(dir)
+	}
+	return nil
+}
+
+// replaceSymlink atomically points link to target
+func replaceSymlink(target, link string) error {
+	tmp := link + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// dockerEnv returns the environment of the docker daemon, which finds
+// containerd and runc through PATH
+func dockerEnv(dockerBinPath string) []string {
+	env := []string{"PATH=" + path.Dir(dockerBinPath) + ":" + os.Getenv("PATH")}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "PATH=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func makeDockerBundle(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "docker/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := files[name]
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func readDockerBinaries(t *testing.T, dir string) map[string]string {
+	binaries := map[string]string{}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isDockerBundleBinary(strings.TrimSuffix(entry.Name(), ".prev")) {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		binaries[entry.Name()] = string(data)
+	}
+	return binaries
+}
+
+func TestInstallDockerBundle(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	dir, err := ioutil.TempDir("", "bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a single binary installed by an older agent
+	if err := ioutil.WriteFile(path.Join(dir, "docker"), []byte("docker 1.9"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := makeDockerBundle(t, map[string]string{
+		"docker/docker":          "docker 17.03",
+		"docker/dockerd":         "dockerd 17.03",
+		"docker/docker-runc":     "runc",
+		"docker/../../etc/shell": "unknown",
+		"docker/README":          "unknown",
+	})
+	if !isDockerBundle(bundle) {
+		t.Fatal("Expected the archive to be detected as a bundle")
+	}
+	if err := installDockerBundle(bundle, dir, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"docker":      "docker 17.03",
+		"dockerd":     "dockerd 17.03",
+		"docker-runc": "runc",
+		"docker.prev": "docker 1.9",
+	}
+	if binaries := readDockerBinaries(t, dir); !reflect.DeepEqual(binaries, expected) {
+		t.Fatalf("Expected %v, got %v", expected, binaries)
+	}
+	if info, err := os.Stat(path.Join(dir, "dockerd")); err != nil || info.Mode().Perm() != 0755 {
+		t.Fatal("Expected dockerd to be executable:", info, err)
+	}
+	// the versions are switched through the current symlink
+	if target, err := os.Readlink(path.Join(dir, "dockerd")); err != nil || target != "current/dockerd" {
+		t.Fatal("Expected dockerd to link to the current version:", target, err)
+	}
+	if versions, err := ioutil.ReadDir(path.Join(dir, "versions")); err != nil || len(versions) != 2 {
+		t.Fatal("Expected the current and previous versions to be kept:", versions, err)
+	}
+
+	// rolling back restores the single binary, and rolling forward the bundle
+	if err := swapDockerBinaries(dir); err != nil {
+		t.Fatal(err)
+	}
+	rolledBack := map[string]string{
+		"docker":           "docker 1.9",
+		"docker.prev":      "docker 17.03",
+		"dockerd.prev":     "dockerd 17.03",
+		"docker-runc.prev": "runc",
+	}
+	if binaries := readDockerBinaries(t, dir); !reflect.DeepEqual(binaries, rolledBack) {
+		t.Fatalf("Expected %v, got %v", rolledBack, binaries)
+	}
+	if err := swapDockerBinaries(dir); err != nil {
+		t.Fatal(err)
+	}
+	if binaries := readDockerBinaries(t, dir); !reflect.DeepEqual(binaries, expected) {
+		t.Fatalf("Expected %v, got %v", expected, binaries)
+	}
+}
+
+func TestInstallDockerBundleInvalid(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	dir, err := ioutil.TempDir("", "bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "docker"), []byte("docker 1.9"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	noClient := makeDockerBundle(t, map[string]string{"docker/dockerd": "dockerd"})
+	if err := installDockerBundle(noClient, dir, true); err == nil {
+		t.Fatal("Expected an error for a bundle without docker client")
+	}
+	truncated := makeDockerBundle(t, map[string]string{"docker/docker": "docker 17.03"})
+	if err := installDockerBundle(truncated[:len(truncated)/2], dir, true); err == nil {
+		t.Fatal("Expected an error for a truncated bundle")
+	}
+
+	expected := map[string]string{"docker": "docker 1.9"}
+	if binaries := readDockerBinaries(t, dir); !reflect.DeepEqual(binaries, expected) {
+		t.Fatalf("Expected the installed docker to be untouched, got %v", binaries)
+	}
+	if versions, err := ioutil.ReadDir(path.Join(dir, "versions")); err != nil || len(versions) != 1 {
+		t.Fatal("Expected the failed versions to be removed:", versions, err)
+	}
+}
+
+func TestInstallDockerFileSingleBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dockerBinPath := path.Join(dir, "docker")
+	newPath := path.Join(dir, "docker.new")
+	if err := ioutil.WriteFile(dockerBinPath, []byte("docker 1.8"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newPath, []byte("docker 1.9"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installDockerFile(newPath, dockerBinPath, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"docker": "docker 1.9", "docker.prev": "docker 1.8"}
+	if binaries := readDockerBinaries(t, dir); !reflect.DeepEqual(binaries, expected) {
+		t.Fatalf("Expected %v, got %v", expected, binaries)
+	}
+}
@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// DockerCapability is a daemon feature which depends on the docker version
+type DockerCapability string
+
+const (
+	CapDaemonSubcommand DockerCapability = "daemon"         // docker daemon, instead of docker -d
+	CapDockerd          DockerCapability = "dockerd"        // separate dockerd binary
+	CapLogDriver        DockerCapability = "log-driver"     // --log-driver
+	CapUserlandProxy    DockerCapability = "userland-proxy" // --userland-proxy
+	CapLogOpts          DockerCapability = "log-opts"       // --log-opt
+	CapConfigFile       DockerCapability = "config-file"    // --config-file (daemon.json)
+	CapLiveRestore      DockerCapability = "live-restore"   // --live-restore
+	CapDataRoot         DockerCapability = "data-root"      // --data-root, replacing --graph
+	CapStatsOneShot     DockerCapability = "stats-one-shot" // stream=false on the stats API
+)
+
+// dockerCapabilityMatrix lists the range of docker versions supporting
+// each capability. A zero Until means the capability is still supported.
+var dockerCapabilityMatrix = []struct {
+	Capability DockerCapability
+	Since      semver.Version
+	Until      semver.Version
+}{
+	{CapDaemonSubcommand, mustVersion("1.8.0"), mustVersion("17.6.0")},
+	{CapDockerd, mustVersion("1.12.0"), semver.Version{}},
+	{CapLogDriver, mustVersion("1.6.0"), semver.Version{}},
+	{CapUserlandProxy, mustVersion("1.7.0"), semver.Version{}},
+	{CapLogOpts, mustVersion("1.8.0"), semver.Version{}},
+	{CapConfigFile, mustVersion("1.10.0"), semver.Version{}},
+	{CapLiveRestore, mustVersion("1.12.0"), semver.Version{}},
+	{CapDataRoot, mustVersion("17.5.0"), semver.Version{}},
+	{CapStatsOneShot, mustVersion("1.7.0"), semver.Version{}},
+}
+
+func mustVersion(s string) semver.Version {
+	v, err := semver.Make(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// DockerCapabilities are the capabilities of a given docker version
+type DockerCapabilities struct {
+	Version      semver.Version
+	capabilities map[DockerCapability]bool
+}
+
+func GetDockerCapabilities(v semver.Version) DockerCapabilities {
+	caps := DockerCapabilities{Version: v, capabilities: map[DockerCapability]bool{}}
+	for _, entry := range dockerCapabilityMatrix {
+		if v.GTE(entry.Since) && (entry.Until.Equals(semver.Version{}) || v.LT(entry.Until)) {
+			caps.capabilities[entry.Capability] = true
+		}
+	}
+	return caps
+}
+
+func (c DockerCapabilities) Supports(capability DockerCapability) bool {
+	return c.capabilities[capability]
+}
+
+// DaemonCommand returns the binary and the leading arguments starting the
+// docker daemon. dockerd is used when installed next to dockerBinPath, and
+// always once docker daemon is gone.
+func (c DockerCapabilities) DaemonCommand(dockerBinPath string) (string, []string) {
+	dockerd := path.Join(path.Dir(dockerBinPath), "dockerd")
+	if c.Supports(CapDockerd) && (!c.Supports(CapDaemonSubcommand) || utils.FileExist(dockerd)) {
+		return dockerd, nil
+	}
+	if c.Supports(CapDaemonSubcommand) {
+		return dockerBinPath, []string{"daemon"}
+	}
+	return dockerBinPath, []string{"-d"}
+}
+
+var dockerVersionRegexp = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// parseDockerVersion extracts the version from the output of docker -v or
+// from the /version API. Leading zeros (17.05.0) are not valid semver, and
+// suffixes (-ce, -rc1) are dropped as they would sort before the release.
+func parseDockerVersion(s string) (semver.Version, error) {
+	match := dockerVersionRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return semver.Version{}, errors.New("no docker version found in " + strconv.Quote(s))
+	}
+	var numbers [3]uint64
+	for i := range numbers {
+		n, err := strconv.ParseUint(match[i+1], 10, 64)
+		if err != nil {
+			return semver.Version{}, err
+		}
+		numbers[i] = n
+	}
+	return semver.Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// getDockerVersion returns the version of the docker binary at dockerBinPath,
+// falling back to asking the running daemon. A zero version is returned if
+// both fail, which only enables the features of the oldest docker.
+func getDockerVersion(dockerBinPath string) semver.Version {
+	out, err := exec.Command(dockerBinPath, "-v").Output()
+	if err == nil {
+		var v semver.Version
+		if v, err = parseDockerVersion(string(out)); err == nil {
+			Logger.Printf("Found docker: version %s (%s)", v, dockerBinPath)
+			return v
+		}
+	}
+	Logger.Printf("Cannot get the version of %s: %s, asking the docker daemon", dockerBinPath, err)
+
+	v, apiErr := getDockerDaemonVersion(DialTimeOut * time.Second)
+	if apiErr == nil {
+		Logger.Printf("Found docker: version %s (daemon)", v)
+		return v
+	}
+	SendError(err, "Failed to get the docker version", map[string]interface{}{"api-error": apiErr.Error()})
+	Logger.Println("Cannot get the docker version from the daemon:", apiErr)
+	return semver.Version{}
+}
+
+// getDockerDaemonVersion returns the version of the running docker daemon
+func getDockerDaemonVersion(timeout time.Duration) (semver.Version, error) {
+	body, err := dockerAPIGet("/version", timeout)
+	if err != nil {
+		return semver.Version{}, err
+	}
+	var version struct {
+		Version string
+	}
+	if err := json.Unmarshal(body, &version); err != nil {
+		return semver.Version{}, err
+	}
+	return parseDockerVersion(version.Version)
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParseDockerVersion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"Docker version 1.5.0, build a8a31ef", "1.5.0", true},
+		{"Docker version 1.8.3, build f4bf5c7\n", "1.8.3", true},
+		{"Docker version 1.13.0-rc1, build 2e43f96", "1.13.0", true},
+		{"Docker version 17.05.0-ce, build 89658be", "17.5.0", true},
+		{"Docker version 17.06.2-ee-16, build 9ef4f0a", "17.6.2", true},
+		{"Docker version 18.09.1, build 4c52b90", "18.9.1", true},
+		{"17.03.1-ce", "17.3.1", true},
+		{"1.12.6", "1.12.6", true},
+		{"Docker version dev, build unknown", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		v, err := parseDockerVersion(test.input)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.input, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.input, err)
+			continue
+		}
+		if v.String() != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.input, test.expected, v)
+		}
+	}
+}
+
+func TestDockerCapabilities(t *testing.T) {
+	all := []DockerCapability{
+		CapDaemonSubcommand, CapDockerd, CapLogDriver, CapUserlandProxy,
+		CapLogOpts, CapConfigFile, CapLiveRestore, CapDataRoot,
+	}
+	tests := []struct {
+		version  string
+		expected []DockerCapability
+	}{
+		{"0.0.0", nil},
+		{"1.5.0", nil},
+		{"1.6.2", []DockerCapability{CapLogDriver}},
+		{"1.7.1", []DockerCapability{CapLogDriver, CapUserlandProxy}},
+		{"1.8.0", []DockerCapability{CapDaemonSubcommand, CapLogDriver, CapUserlandProxy, CapLogOpts}},
+		{"1.9.1", []DockerCapability{CapDaemonSubcommand, CapLogDriver, CapUserlandProxy, CapLogOpts}},
+		{"1.10.3", []DockerCapability{CapDaemonSubcommand, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile}},
+		{"1.11.2", []DockerCapability{CapDaemonSubcommand, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile}},
+		{"1.12.0", []DockerCapability{CapDaemonSubcommand, CapDockerd, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile, CapLiveRestore}},
+		{"17.3.1", []DockerCapability{CapDaemonSubcommand, CapDockerd, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile, CapLiveRestore}},
+		{"17.5.0", []DockerCapability{CapDaemonSubcommand, CapDockerd, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile, CapLiveRestore, CapDataRoot}},
+		{"17.6.0", []DockerCapability{CapDockerd, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile, CapLiveRestore, CapDataRoot}},
+		{"18.9.1", []DockerCapability{CapDockerd, CapLogDriver, CapUserlandProxy, CapLogOpts, CapConfigFile, CapLiveRestore, CapDataRoot}},
+	}
+	for _, test := range tests {
+		caps := GetDockerCapabilities(mustVersion(test.version))
+		expected := map[DockerCapability]bool{}
+		for _, capability := range test.expected {
+			expected[capability] = true
+		}
+		for _, capability := range all {
+			if caps.Supports(capability) != expected[capability] {
+				t.Errorf("%s: expected %s support to be %t", test.version, capability, expected[capability])
+			}
+		}
+	}
+}
+
+func TestDockerCapabilitiesMatrixIsComplete(t *testing.T) {
+	seen := map[DockerCapability]bool{}
+	for _, entry := range dockerCapabilityMatrix {
+		if seen[entry.Capability] {
+			t.Errorf("%s is listed twice", entry.Capability)
+		}
+		seen[entry.Capability] = true
+		if entry.Until.Major != 0 && !entry.Since.LT(entry.Until) {
+			t.Errorf("%s: empty version range %s-%s", entry.Capability, entry.Since, entry.Until)
+		}
+	}
+}
+
+func TestDaemonCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capabilities-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withDockerd := path.Join(dir, "bundle")
+	if err := os.MkdirAll(withDockerd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(withDockerd, "dockerd"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	docker := path.Join(dir, "docker")
+	bundleDocker := path.Join(withDockerd, "docker")
+
+	tests := []struct {
+		version      string
+		binPath      string
+		expectedBin  string
+		expectedArgs []string
+	}{
+		{"1.5.0", docker, docker, []string{"-d"}},
+		{"1.7.1", docker, docker, []string{"-d"}},
+		{"1.8.0", docker, docker, []string{"daemon"}},
+		{"1.11.2", bundleDocker, bundleDocker, []string{"daemon"}},
+		{"1.12.0", docker, docker, []string{"daemon"}},
+		{"1.12.0", bundleDocker, path.Join(withDockerd, "dockerd"), nil},
+		{"17.5.0", bundleDocker, path.Join(withDockerd, "dockerd"), nil},
+		{"17.6.0", docker, path.Join(dir, "dockerd"), nil},
+	}
+	for _, test := range tests {
+		bin, args := GetDockerCapabilities(mustVersion(test.version)).DaemonCommand(test.binPath)
+		if bin != test.expectedBin || !reflect.DeepEqual(args, test.expectedArgs) {
+			t.Errorf("%s %s: expected %s %v, got %s %v", test.version, test.binPath, test.expectedBin, test.expectedArgs, bin, args)
+		}
+	}
+}
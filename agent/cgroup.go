@@ -0,0 +1,259 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+var CgroupRoot = "/sys/fs/cgroup"
+
+const cgroupCPUPeriod = 100000 //microseconds
+
+// CgroupLimits are the resources granted to the docker daemon cgroup. Zero
+// values are left to the kernel defaults.
+type CgroupLimits struct {
+	MemoryLimit       int64 //bytes
+	MemoryReservation int64 //bytes
+	CPUShares         int64
+	CPUQuota          int64 //percent of one CPU
+}
+
+// CgroupUsage is the resource usage of the docker daemon cgroup
+type CgroupUsage struct {
+	Version     int    `json:"version"`
+	Path        string `json:"path"`
+	MemoryUsage int64  `json:"memory_usage"` //bytes
+	CPUUsage    int64  `json:"cpu_usage"`    //microseconds
+}
+
+// DockerCgroup places the docker daemon in a dedicated cgroup, on either
+// the v1 (one hierarchy per controller) or v2 (unified) hierarchy
+type DockerCgroup struct {
+	Name    string
+	Limits  CgroupLimits
+	version int
+}
+
+func NewDockerCgroup(name string, limits CgroupLimits) *DockerCgroup {
+	version := 1
+	if utils.FileExist(path.Join(CgroupRoot, "cgroup.controllers")) {
+		version = 2
+	}
+	return &DockerCgroup{Name: name, Limits: limits, version: version}
+}
+
+// GetCgroupLimits returns the limits from the configuration
+func GetCgroupLimits() CgroupLimits {
+	return CgroupLimits{
+		MemoryLimit:       Conf.DockerMemoryLimit * 1024 * 1024,
+		MemoryReservation: Conf.DockerMemoryReservation * 1024 * 1024,
+		CPUShares:         Conf.DockerCPUShares,
+		CPUQuota:          Conf.DockerCPUQuota,
+	}
+}
+
+func (c *DockerCgroup) dir(controller string) string {
+	if c.version == 2 {
+		return path.Join(CgroupRoot, c.Name)
+	}
+	return path.Join(CgroupRoot, controller, c.Name)
+}
+
+// Setup creates the cgroup and applies its limits
+func (c *DockerCgroup) Setup() error {
+	if c.version == 2 {
+		return c.setupV2()
+	}
+	return c.setupV1()
+}
+
+func (c *DockerCgroup) setupV1() error {
+	memory := c.dir("memory")
+	cpu := c.dir("cpu")
+	// cpuacct is not always mounted along with cpu, and holds the CPU usage
+	for _, dir := range []string{memory, cpu, c.dir("cpuacct")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if c.Limits.MemoryLimit > 0 {
+		if err := writeCgroupFile(memory, "memory.limit_in_bytes", c.Limits.MemoryLimit); err != nil {
+			return err
+		}
+	}
+	if c.Limits.MemoryReservation > 0 {
+		if err := writeCgroupFile(memory, "memory.soft_limit_in_bytes", c.Limits.MemoryReservation); err != nil {
+			return err
+		}
+	}
+	if c.Limits.CPUShares > 0 {
+		if err := writeCgroupFile(cpu, "cpu.shares", c.Limits.CPUShares); err != nil {
+			return err
+		}
+	}
+	if c.Limits.CPUQuota > 0 {
+		if err := writeCgroupFile(cpu, "cpu.cfs_period_us", cgroupCPUPeriod); err != nil {
+			return err
+		}
+		if err := writeCgroupFile(cpu, "cpu.cfs_quota_us", c.Limits.CPUQuota*cgroupCPUPeriod/100); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DockerCgroup) setupV2() error {
+	// controllers must be enabled in the parent before they can be used
+	err := ioutil.WriteFile(path.Join(CgroupRoot, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+	if err != nil {
+		return errors.New("Cannot enable memory and cpu controllers: " + err.Error())
+	}
+	dir := c.dir("")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if c.Limits.MemoryLimit > 0 {
+		if err := writeCgroupFile(dir, "memory.max", c.Limits.MemoryLimit); err != nil {
+			return err
+		}
+	}
+	if c.Limits.MemoryReservation > 0 {
+		if err := writeCgroupFile(dir, "memory.low", c.Limits.MemoryReservation); err != nil {
+			return err
+		}
+	}
+	if c.Limits.CPUShares > 0 {
+		if err := writeCgroupFile(dir, "cpu.weight", cpuSharesToWeight(c.Limits.CPUShares)); err != nil {
+			return err
+		}
+	}
+	if c.Limits.CPUQuota > 0 {
+		quota := fmt.Sprintf("%d %d", c.Limits.CPUQuota*cgroupCPUPeriod/100, cgroupCPUPeriod)
+		if err := ioutil.WriteFile(path.Join(dir, "cpu.max"), []byte(quota), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cpuSharesToWeight converts cgroup v1 cpu.shares [2-262144] to cgroup v2
+// cpu.weight [1-10000]
+func cpuSharesToWeight(shares int64) int64 {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func (c *DockerCgroup) dirs() []string {
+	if c.version == 1 {
+		return []string{c.dir("memory"), c.dir("cpu"), c.dir("cpuacct")}
+	}
+	return []string{c.dir("")}
+}
+
+// AddProcess moves a process into the cgroup
+func (c *DockerCgroup) AddProcess(pid int) error {
+	for _, dir := range c.dirs() {
+		if err := writeCgroupFile(dir, "cgroup.procs", int64(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Command wraps cmd in a shell which joins the cgroup before exec'ing it, so
+// that docker and everything it starts are in the cgroup from the beginning
+func (c *DockerCgroup) Command(cmd *exec.Cmd) *exec.Cmd {
+	args := []string{"-c", `while [ "$1" != -- ]; do echo $$ > "$1"; shift; done; shift; exec "$@"`, "sh"}
+	for _, dir := range c.dirs() {
+		args = append(args, path.Join(dir, "cgroup.procs"))
+	}
+	args = append(append(args, "--", cmd.Path), cmd.Args[1:]...)
+	wrapped := exec.Command("/bin/sh", args...)
+	wrapped.Env = cmd.Env
+	wrapped.ExtraFiles = cmd.ExtraFiles
+	return wrapped
+}
+
+// Usage returns the current resource usage of the cgroup
+func (c *DockerCgroup) Usage() (CgroupUsage, error) {
+	usage := CgroupUsage{Version: c.version, Path: "/" + c.Name}
+	var err error
+	if c.version == 2 {
+		if usage.MemoryUsage, err = readCgroupFile(c.dir(""), "memory.current"); err != nil {
+			return usage, err
+		}
+		data, err := ioutil.ReadFile(path.Join(c.dir(""), "cpu.stat"))
+		if err != nil {
+			return usage, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				usage.CPUUsage, _ = strconv.ParseInt(fields[1], 10, 64)
+			}
+		}
+		return usage, nil
+	}
+	if usage.MemoryUsage, err = readCgroupFile(c.dir("memory"), "memory.usage_in_bytes"); err != nil {
+		return usage, err
+	}
+	cpuacct, err := readCgroupFile(c.dir("cpuacct"), "cpuacct.usage")
+	if err != nil {
+		return usage, err
+	}
+	usage.CPUUsage = cpuacct / 1000
+	return usage, nil
+}
+
+func writeCgroupFile(dir, file string, value int64) error {
+	return ioutil.WriteFile(path.Join(dir, file), []byte(strconv.FormatInt(value, 10)), 0644)
+}
+
+func readCgroupFile(dir, file string) (int64, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// dockerCgroupCommand sets up the configured cgroup of the docker daemon,
+// and makes cmd join it before starting docker
+func dockerCgroupCommand(cmd *exec.Cmd) *exec.Cmd {
+	if DockerCgroupManager == nil || IsUnprivileged() {
+		return cmd
+	}
+	if err := DockerCgroupManager.Setup(); err != nil {
+		SendError(err, "Failed to set up docker cgroup", nil)
+		Logger.Println("Cannot set up docker cgroup:", err)
+		return cmd
+	}
+	return DockerCgroupManager.Command(cmd)
+}
+
+// placeDockerInCgroup checks that the docker daemon joined its configured
+// cgroup, moving it there otherwise
+func placeDockerInCgroup(pid int) {
+	if DockerCgroupManager == nil {
+		return
+	}
+	if err := DockerCgroupManager.AddProcess(pid); err != nil {
+		SendError(err, "Failed to move docker into its cgroup", nil)
+		Logger.Println("Cannot move docker into its cgroup:", err)
+		return
+	}
+	Logger.Printf("Docker daemon (PID:%d) placed in cgroup /%s", pid, DockerCgroupManager.Name)
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func readTestFile(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestDockerCgroupV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root string) { CgroupRoot = root }(CgroupRoot)
+	CgroupRoot = dir
+
+	limits := CgroupLimits{MemoryLimit: 512 * 1024 * 1024, CPUShares: 512, CPUQuota: 150}
+	c := NewDockerCgroup("tutum-docker", limits)
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	if v := readTestFile(t, path.Join(dir, "memory/tutum-docker/memory.limit_in_bytes")); v != "536870912" {
+		t.Fatal("Unexpected memory limit:", v)
+	}
+	if v := readTestFile(t, path.Join(dir, "cpu/tutum-docker/cpu.shares")); v != "512" {
+		t.Fatal("Unexpected cpu shares:", v)
+	}
+	if v := readTestFile(t, path.Join(dir, "cpu/tutum-docker/cpu.cfs_quota_us")); v != "150000" {
+		t.Fatal("Unexpected cpu quota:", v)
+	}
+	if err := c.AddProcess(42); err != nil {
+		t.Fatal(err)
+	}
+	if v := readTestFile(t, path.Join(dir, "memory/tutum-docker/cgroup.procs")); v != "42" {
+		t.Fatal("Unexpected cgroup procs:", v)
+	}
+	if v := readTestFile(t, path.Join(dir, "cpuacct/tutum-docker/cgroup.procs")); v != "42" {
+		t.Fatal("Unexpected cpuacct cgroup procs:", v)
+	}
+
+	ioutil.WriteFile(path.Join(dir, "memory/tutum-docker/memory.usage_in_bytes"), []byte("1024\n"), 0644)
+	ioutil.WriteFile(path.Join(dir, "cpuacct/tutum-docker/cpuacct.usage"), []byte("5000000\n"), 0644)
+	usage, err := c.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.MemoryUsage != 1024 || usage.CPUUsage != 5000 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+}
+
+func TestDockerCgroupV2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root string) { CgroupRoot = root }(CgroupRoot)
+	CgroupRoot = dir
+	if err := ioutil.WriteFile(path.Join(dir, "cgroup.controllers"), []byte("cpu memory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := CgroupLimits{MemoryLimit: 1024, MemoryReservation: 512, CPUShares: 1024, CPUQuota: 50}
+	c := NewDockerCgroup("tutum-docker", limits)
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	cgroup := path.Join(dir, "tutum-docker")
+	if v := readTestFile(t, path.Join(dir, "cgroup.subtree_control")); v != "+memory +cpu" {
+		t.Fatal("Unexpected subtree control:", v)
+	}
+	if v := readTestFile(t, path.Join(cgroup, "memory.max")); v != "1024" {
+		t.Fatal("Unexpected memory max:", v)
+	}
+	if v := readTestFile(t, path.Join(cgroup, "memory.low")); v != "512" {
+		t.Fatal("Unexpected memory low:", v)
+	}
+	if v := readTestFile(t, path.Join(cgroup, "cpu.weight")); v != "39" {
+		t.Fatal("Unexpected cpu weight:", v)
+	}
+	if v := readTestFile(t, path.Join(cgroup, "cpu.max")); v != "50000 100000" {
+		t.Fatal("Unexpected cpu max:", v)
+	}
+
+	ioutil.WriteFile(path.Join(cgroup, "memory.current"), []byte("4096\n"), 0644)
+	ioutil.WriteFile(path.Join(cgroup, "cpu.stat"), []byte("usage_usec 1234\nuser_usec 1000\n"), 0644)
+	usage, err := c.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Version != 2 || usage.MemoryUsage != 4096 || usage.CPUUsage != 1234 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+}
+
+func TestDockerCgroupCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root string) { CgroupRoot = root }(CgroupRoot)
+	CgroupRoot = dir
+
+	c := NewDockerCgroup("tutum-docker", CgroupLimits{})
+	if err := c.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	// the command joins the cgroup before it runs, with the same pid
+	cmd := exec.Command("sh", "-c", `echo $$ "$@"`, "sh", "a b", "c")
+	cmd.Env = []string{"FOO=bar"}
+	wrapped := c.Command(cmd)
+	if len(wrapped.Env) != 1 || wrapped.Env[0] != "FOO=bar" {
+		t.Fatal("Expected the environment to be kept, got", wrapped.Env)
+	}
+	out, err := wrapped.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(out)), " ", 2)
+	if len(fields) != 2 || fields[1] != "a b c" {
+		t.Fatalf("Expected the arguments to be kept, got %q", out)
+	}
+	for _, controller := range []string{"memory", "cpu", "cpuacct"} {
+		if v := readTestFile(t, path.Join(dir, controller, "tutum-docker/cgroup.procs")); v != fields[0] {
+			t.Fatalf("Expected process %s in the %s cgroup, got %s", fields[0], controller, v)
+		}
+	}
+}
@@ -20,6 +20,102 @@ type Configuration struct {
 	TutumToken     string
 	TutumUUID      string
 	DockerOpts     string
+
+	// Docker daemon settings, rendered to flags by getDockerStartOpt
+	DockerStorageDriver      string            `json:",omitempty"`
+	DockerStorageOpts        []string          `json:",omitempty"`
+	DockerGraph              string            `json:",omitempty"`
+	DockerRegistryMirrors    []string          `json:",omitempty"`
+	DockerInsecureRegistries []string          `json:",omitempty"`
+	DockerDNS                []string          `json:",omitempty"`
+	DockerLogDriver          string            `json:",omitempty"`
+	DockerLogOpts            map[string]string `json:",omitempty"`
+	DockerBridge             string            `json:",omitempty"`
+	DockerBip                string            `json:",omitempty"`
+	DockerLabels             []string          `json:",omitempty"`
+	DockerLiveRestore        bool              `json:",omitempty"`
+
+	// Base daemon.json merged into the one generated for newer docker versions
+	DockerDaemonConfigBase string `json:",omitempty"`
+
+	// Give up restarting docker after DockerCrashLoopCount crashes
+	// within DockerCrashLoopWindow minutes
+	DockerCrashLoopCount  int `json:",omitempty"`
+	DockerCrashLoopWindow int `json:",omitempty"`
+
+	// Seconds to wait for docker to stop before sending SIGKILL
+	DockerStopTimeout int `json:",omitempty"`
+
+	// Restart docker after DockerHealthCheckRetries consecutive failed API
+	// checks, run every DockerHealthCheckInterval seconds
+	DockerHealthCheckInterval int `json:",omitempty"`
+	DockerHealthCheckTimeout  int `json:",omitempty"`
+	DockerHealthCheckRetries  int `json:",omitempty"`
+
+	// Niceness and oom_score_adj of the docker daemon and of its containers
+	DockerNice           *int `json:",omitempty"`
+	ContainerNice        *int `json:",omitempty"`
+	DockerOOMScoreAdj    *int `json:",omitempty"`
+	ContainerOOMScoreAdj *int `json:",omitempty"`
+
+	// Dedicated cgroup of the docker daemon, with memory limits in MB and a
+	// CPU quota in percent of one CPU
+	DockerCgroup            string `json:",omitempty"`
+	DockerMemoryLimit       int64  `json:",omitempty"`
+	DockerMemoryReservation int64  `json:",omitempty"`
+	DockerCPUShares         int64  `json:",omitempty"`
+	DockerCPUQuota          int64  `json:",omitempty"`
+
+	// Use the docker engine managed by the init system instead of running
+	// one, configured through a systemd drop-in or daemon.json
+	DockerExternal       bool   `json:",omitempty"`
+	DockerExternalMethod string `json:",omitempty"`
+
+	// Rotation of docker.log, once bigger than DockerDaemonLogMaxSize MB or
+	// older than DockerDaemonLogMaxAge hours, and its forwarding to syslog
+	// or journald
+	DockerDaemonLogMaxSize   int64  `json:",omitempty"`
+	DockerDaemonLogMaxAge    int    `json:",omitempty"`
+	DockerDaemonLogRetention *int   `json:",omitempty"`
+	DockerDaemonLogForward   string `json:",omitempty"`
+
+	// Public keys trusted to sign downloads, in addition to the embedded
+	// Tutum key (armored or binary keyring)
+	ExtraKeyring string `json:",omitempty"`
+
+	// Check DockerBinaryURL for new docker versions every
+	// DockerUpgradeCheckInterval seconds, unless pinned to DockerVersion
+	DockerUpgradeCheckInterval int    `json:",omitempty"`
+	DockerVersion              string `json:",omitempty"`
+
+	// Hold staged docker upgrades until one of the windows opens, e.g.
+	// "Sat,Sun 02:00-06:00", in DockerMaintenanceTimezone (local by default)
+	DockerMaintenanceWindows  []string `json:",omitempty"`
+	DockerMaintenanceTimezone string   `json:",omitempty"`
+
+	// Seconds between two samples of the node and container metrics, and
+	// between two summaries of them sent to Tutum
+	MetricsCollectInterval int `json:",omitempty"`
+	MetricsPushInterval    int `json:",omitempty"`
+
+	// Ship container logs to "tutum", "syslog" or "file" (ContainerLogFile),
+	// starting with the last ContainerLogTailLines lines of each container
+	// and dropping lines over ContainerLogRateLimit per second
+	ContainerLogSink      string `json:",omitempty"`
+	ContainerLogFile      string `json:",omitempty"`
+	ContainerLogTailLines int    `json:",omitempty"`
+	ContainerLogRateLimit *int   `json:",omitempty"`
+
+	// Remove exited containers older than GCContainerMinAge minutes and
+	// unused images once the docker data root is used above GCHighWatermark
+	// percent, until below GCLowWatermark, keeping GCKeepImages and what has
+	// one of GCKeepLabels ("key" or "key=value"), if GCEnabled is set
+	GCEnabled         bool     `json:",omitempty"`
+	GCHighWatermark   int      `json:",omitempty"`
+	GCLowWatermark    int      `json:",omitempty"`
+	GCContainerMinAge int      `json:",omitempty"`
+	GCKeepImages      []string `json:",omitempty"`
+	GCKeepLabels      []string `json:",omitempty"`
 }
 
 func ParseFlag() {
@@ -35,6 +131,13 @@ func ParseFlag() {
 	FlagNgrokToken = flag.String("ngrok-token", "", "ngrok token for NAT tunneling")
 	FlagNgrokHost = flag.String("ngrok-host", "", "ngrok host for NAT tunneling")
 	FlagVersion = flag.Bool("v", false, "show version")
+	FlagRoot = flag.String("root", "", "Prefix for all the default agent directories")
+	FlagTutumHome = flag.String("tutum-home", "", "Override the agent config directory")
+	FlagDockerDir = flag.String("docker-dir", "", "Override the docker binary directory")
+	FlagLogDir = flag.String("log-dir", "", "Override the log directory")
+	FlagPidFile = flag.String("pid-file", "", "Override the agent pid file")
+	FlagDockerSymlink = flag.String("docker-symlink", "", "Override the docker client symbolic link")
+	FlagExternalDocker = flag.Bool("external-docker", false, "Use the docker engine managed by the init system")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -45,13 +148,31 @@ func ParseFlag() {
 			"          TutumHost=\"xxx\"\n",
 			"          TutumToken=\"xxx\"\n",
 			"          TutumUUID=\"xxx\"\n",
-			"          DockerOpts=\"xxx\"\n")
+			"          DockerOpts=\"xxx\"\n",
+			"          DockerStorageDriver=\"xxx\"\n",
+			"          DockerStorageOpts=\"xxx,yyy\"\n",
+			"          DockerGraph=\"xxx\"\n",
+			"          DockerRegistryMirrors=\"xxx,yyy\"\n",
+			"          DockerInsecureRegistries=\"xxx,yyy\"\n",
+			"          DockerDNS=\"xxx,yyy\"\n",
+			"          DockerLogDriver=\"xxx\"\n",
+			"          DockerLogOpts=\"key=value,key=value\"\n",
+			"          DockerBridge=\"xxx\"\n",
+			"          DockerBip=\"xxx\"\n",
+			"          DockerLabels=\"key=value,key=value\"\n",
+			"          DockerExternal=\"true|false\"\n",
+			"          DockerExternalMethod=\"systemd|daemon.json\"\n",
+			"   docker rollback: Restore the docker binary used before the last upgrade\n",
+			"   docker upgrade-now: Apply the staged docker upgrade outside of maintenance windows\n",
+			"   preflight: Check that the host can run docker and exit\n",
+			"   metrics [container]: Print the metrics of the last hour, of all the containers or of one\n")
 	}
 	flag.Parse()
 
 	if *FlagNgrokHost != "" {
 		NgrokHost = *FlagNgrokHost
 	}
+	SetPaths(*FlagRoot, *FlagTutumHome, *FlagDockerDir, *FlagLogDir, *FlagPidFile, *FlagDockerSymlink)
 }
 
 func SetConfigFile(configFilePath string) {
@@ -89,6 +210,37 @@ func SetConfigFile(configFilePath string) {
 					Conf.TutumUUID = value
 				} else if strings.ToLower(key) == strings.ToLower("DockerOpts") {
 					Conf.DockerOpts = value
+				} else if strings.ToLower(key) == strings.ToLower("DockerStorageDriver") {
+					Conf.DockerStorageDriver = value
+				} else if strings.ToLower(key) == strings.ToLower("DockerStorageOpts") {
+					Conf.DockerStorageOpts = splitList(value)
+				} else if strings.ToLower(key) == strings.ToLower("DockerGraph") {
+					Conf.DockerGraph = value
+				} else if strings.ToLower(key) == strings.ToLower("DockerRegistryMirrors") {
+					Conf.DockerRegistryMirrors = splitList(value)
+				} else if strings.ToLower(key) == strings.ToLower("DockerInsecureRegistries") {
+					Conf.DockerInsecureRegistries = splitList(value)
+				} else if strings.ToLower(key) == strings.ToLower("DockerDNS") {
+					Conf.DockerDNS = splitList(value)
+				} else if strings.ToLower(key) == strings.ToLower("DockerLogDriver") {
+					Conf.DockerLogDriver = value
+				} else if strings.ToLower(key) == strings.ToLower("DockerLogOpts") {
+					Conf.DockerLogOpts = splitMap(value)
+				} else if strings.ToLower(key) == strings.ToLower("DockerBridge") {
+					Conf.DockerBridge = value
+				} else if strings.ToLower(key) == strings.ToLower("DockerBip") {
+					Conf.DockerBip = value
+				} else if strings.ToLower(key) == strings.ToLower("DockerLabels") {
+					Conf.DockerLabels = splitList(value)
+				} else if strings.ToLower(key) == strings.ToLower("DockerExternal") {
+					external, err := strconv.ParseBool(value)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Invalid value \"%s\" for DockerExternal\n", value)
+						os.Exit(1)
+					}
+					Conf.DockerExternal = external
+				} else if strings.ToLower(key) == strings.ToLower("DockerExternalMethod") {
+					Conf.DockerExternalMethod = value
 				} else {
 					fmt.Fprintf(os.Stderr, "Unsupported item \"%s\" in \"tutum-agent set\" command\n", key)
 					os.Exit(1)
@@ -96,6 +248,10 @@ func SetConfigFile(configFilePath string) {
 			}
 		}
 	}
+	if err := ValidateDockerConf(Conf); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid docker settings:", err)
+		os.Exit(1)
+	}
 	if err := SaveConf(configFilePath, Conf); err != nil {
 		SendError(err, "Failed to save config to the conf file", nil)
 		fmt.Fprintf(os.Stderr, err.Error())
@@ -126,9 +282,35 @@ func LoadConf(configFile string) (*Configuration, error) {
 	if conf.TutumHost == "" {
 		conf.TutumHost = defaultTutumHost
 	}
+	if err = ValidateDockerConf(conf); err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
 
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func splitMap(value string) map[string]string {
+	m := map[string]string{}
+	for _, item := range splitList(value) {
+		keyValue := strings.SplitN(item, "=", 2)
+		if len(keyValue) == 2 {
+			m[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+		} else {
+			m[item] = ""
+		}
+	}
+	return m
+}
+
 func SaveConf(configFile string, conf Configuration) error {
 	f, err := os.OpenFile(configFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -171,12 +353,19 @@ func SetLogger(logFile string) {
 	}
 }
 
-func checkPidFile(pidFile string) {
+func isAgentRunning(pidFile string) bool {
 	if pid, err := ioutil.ReadFile(pidFile); err == nil {
 		if _, err := os.Stat(path.Join("/proc", string(pid))); err == nil {
-			Logger.Fatal("Found pid file, make sure that tutum-agent is not running or remove ", pidFile)
+			return true
 		}
 	}
+	return false
+}
+
+func checkPidFile(pidFile string) {
+	if isAgentRunning(pidFile) {
+		Logger.Fatal("Found pid file, make sure that tutum-agent is not running or remove ", pidFile)
+	}
 }
 
 func CreatePidFile(pidFile string) {
@@ -0,0 +1,439 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sinks the container logs can be shipped to
+const (
+	ContainerLogSinkTutum  = "tutum"
+	ContainerLogSinkSyslog = "syslog"
+	ContainerLogSinkFile   = "file"
+)
+
+// ContainerLogLine is a line logged by a container, with its metadata
+type ContainerLogLine struct {
+	Time          time.Time         `json:"time"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Image         string            `json:"image"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Stream        string            `json:"stream"`
+	Line          string            `json:"line"`
+}
+
+// LogSink receives the container logs in batches
+type LogSink interface {
+	Write(lines []ContainerLogLine) error
+}
+
+type tutumLogSink struct{}
+
+func (tutumLogSink) Write(lines []ContainerLogLine) error {
+	return postNode(ContainerLogsEndpoint, lines)
+}
+
+type syslogLogSink struct {
+	writer *syslog.Writer
+}
+
+func (s syslogLogSink) Write(lines []ContainerLogLine) error {
+	for _, line := range lines {
+		msg := fmt.Sprintf("%s[%.12s]: %s", line.ContainerName, line.ContainerID, line.Line)
+		var err error
+		if line.Stream == "stderr" {
+			err = s.writer.Err(msg)
+		} else {
+			err = s.writer.Info(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileLogSink writes the lines as JSON to a file rotated like docker.log
+type fileLogSink struct {
+	log *DockerLog
+}
+
+func (s fileLogSink) Write(lines []ContainerLogLine) error {
+	for _, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		if _, err := s.log.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newLogSink returns the sink configured by ContainerLogSink
+func newLogSink(conf Configuration) (LogSink, error) {
+	switch conf.ContainerLogSink {
+	case ContainerLogSinkTutum:
+		return tutumLogSink{}, nil
+	case ContainerLogSinkSyslog:
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "tutum-containers")
+		if err != nil {
+			return nil, err
+		}
+		return syslogLogSink{w}, nil
+	case ContainerLogSinkFile:
+		file := conf.ContainerLogFile
+		if file == "" {
+			file = path.Join(LogDir, ContainerLogFileName)
+		}
+		return fileLogSink{NewDockerLog(file, DockerDaemonLogMaxSize*1024*1024, DockerDaemonLogMaxAge*time.Hour, DockerDaemonLogRetention, 0)}, nil
+	}
+	return nil, fmt.Errorf("unknown container log sink %q", conf.ContainerLogSink)
+}
+
+// rateLimiter is a token bucket allowing Rate lines per second, in bursts
+// of up to Rate lines
+type rateLimiter struct {
+	rate    float64
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+func (r *rateLimiter) allow(now time.Time) bool {
+	if r.rate <= 0 {
+		return true
+	}
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.rate {
+			r.tokens = r.rate
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		r.dropped++
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+type logContainer struct {
+	ID     string `json:"Id"`
+	Names  []string
+	Image  string
+	Labels map[string]string
+}
+
+func (c logContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+// ContainerLogShipper follows the logs of the running containers and ships
+// them in batches to a sink. A sink which cannot keep up blocks the
+// followers, leaving the lines in the docker logs until they are read.
+// Containers logging more than RateLimit lines per second have their
+// excess lines dropped.
+type ContainerLogShipper struct {
+	RateLimit     int
+	TailLines     int
+	BatchSize     int
+	FlushInterval time.Duration
+
+	sink      LogSink
+	lines     chan ContainerLogLine
+	mutex     sync.Mutex
+	following map[string]bool
+	last      map[string]time.Time
+}
+
+func NewContainerLogShipper(sink LogSink) *ContainerLogShipper {
+	s := &ContainerLogShipper{
+		RateLimit:     ContainerLogRateLimit,
+		TailLines:     Conf.ContainerLogTailLines,
+		BatchSize:     ContainerLogBatchSize,
+		FlushInterval: ContainerLogFlushInterval * time.Second,
+		sink:          sink,
+		lines:         make(chan ContainerLogLine, ContainerLogBatchSize),
+		following:     map[string]bool{},
+		last:          map[string]time.Time{},
+	}
+	if Conf.ContainerLogRateLimit != nil {
+		s.RateLimit = *Conf.ContainerLogRateLimit
+	}
+	return s
+}
+
+// ShipContainerLogs ships the container logs to ContainerLogSink, forever,
+// unless no sink is configured
+func ShipContainerLogs() {
+	if Conf.ContainerLogSink == "" {
+		return
+	}
+	sink, err := newLogSink(Conf)
+	if err != nil {
+		SendError(err, "Failed to open the container log sink", nil)
+		Logger.Println("Cannot ship container logs:", err)
+		return
+	}
+	Logger.Println("Shipping container logs to", Conf.ContainerLogSink)
+	s := NewContainerLogShipper(sink)
+	go s.Ship()
+	s.Watch()
+}
+
+// Watch follows the logs of new containers, forever
+func (s *ContainerLogShipper) Watch() {
+	for {
+		WaitDockerReady()
+		if err := s.followNew(); err != nil && *FlagDebugMode {
+			Logger.Println("Cannot list the containers to follow their logs:", err)
+		}
+		if err := s.forgetRemoved(); err != nil && *FlagDebugMode {
+			Logger.Println("Cannot list the containers to forget the removed ones:", err)
+		}
+		time.Sleep(HeartBeatInterval * time.Second)
+	}
+}
+
+func (s *ContainerLogShipper) followNew() error {
+	body, err := dockerAPIGet("/containers/json", DialTimeOut*time.Second)
+	if err != nil {
+		return err
+	}
+	var containers []logContainer
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range containers {
+		if !s.following[c.ID] {
+			s.following[c.ID] = true
+			go s.follow(c)
+		}
+	}
+	return nil
+}
+
+// forgetRemoved drops the resume time of the containers removed from
+// docker. Stopped containers keep it, to resume their logs once restarted.
+func (s *ContainerLogShipper) forgetRemoved() error {
+	body, err := dockerAPIGet("/containers/json?all=1", DialTimeOut*time.Second)
+	if err != nil {
+		return err
+	}
+	var containers []logContainer
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, c := range containers {
+		existing[c.ID] = true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id := range s.last {
+		if !existing[id] && !s.following[id] {
+			delete(s.last, id)
+		}
+	}
+	return nil
+}
+
+// follow ships the logs of c until its log stream ends, when it stops or
+// when docker restarts. The stream is then resumed from the last line.
+func (s *ContainerLogShipper) follow(c logContainer) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.following, c.ID)
+		s.mutex.Unlock()
+	}()
+	if err := s.followOnce(c); err != nil && *FlagDebugMode {
+		Logger.Printf("Stopped following the logs of %s: %s", c.name(), err)
+	}
+}
+
+func (s *ContainerLogShipper) followOnce(c logContainer) error {
+	body, err := dockerAPIGet("/containers/"+c.ID+"/json", DialTimeOut*time.Second)
+	if err != nil {
+		return err
+	}
+	var inspect struct {
+		Config struct {
+			Tty bool
+		}
+	}
+	if err := json.Unmarshal(body, &inspect); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	last := s.last[c.ID]
+	s.mutex.Unlock()
+	query := fmt.Sprintf("follow=1&stdout=1&stderr=1&timestamps=1&tail=%d", s.TailLines)
+	if !last.IsZero() {
+		query = fmt.Sprintf("follow=1&stdout=1&stderr=1&timestamps=1&since=%d", last.Unix())
+	}
+	stream, err := dockerAPIStream("/containers/" + c.ID + "/logs?" + query)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	limiter := newRateLimiter(s.RateLimit)
+	return demuxDockerLogs(stream, inspect.Config.Tty, func(name, line string) {
+		t, line := splitLogTimestamp(line)
+		if !last.IsZero() && !t.After(last) {
+			// already shipped before the stream was resumed
+			return
+		}
+		last = t
+		s.mutex.Lock()
+		s.last[c.ID] = t
+		s.mutex.Unlock()
+
+		if !limiter.allow(time.Now()) {
+			return
+		}
+		if limiter.dropped > 0 {
+			s.lines <- s.newLine(c, t, "stderr", fmt.Sprintf("[tutum-agent] %d lines dropped, over %d lines per second", limiter.dropped, s.RateLimit))
+			limiter.dropped = 0
+		}
+		s.lines <- s.newLine(c, t, name, line)
+	})
+}
+
+func (s *ContainerLogShipper) newLine(c logContainer, t time.Time, stream, line string) ContainerLogLine {
+	return ContainerLogLine{
+		Time:          t,
+		ContainerID:   c.ID,
+		ContainerName: c.name(),
+		Image:         c.Image,
+		Labels:        c.Labels,
+		Stream:        stream,
+		Line:          line,
+	}
+}
+
+// Ship sends the lines in batches of up to BatchSize, at least every
+// FlushInterval, forever. Batches the sink fails to write are retried.
+func (s *ContainerLogShipper) Ship() {
+	for {
+		batch := s.nextBatch()
+		backoff := time.Second
+		for {
+			err := s.sink.Write(batch)
+			if err == nil {
+				break
+			}
+			Logger.Printf("Cannot ship %d container log lines, retrying in %s: %s", len(batch), backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > MaxWaitingTime*time.Second {
+				backoff = MaxWaitingTime * time.Second
+			}
+		}
+	}
+}
+
+// nextBatch waits for a line, and returns it with the lines received until
+// the batch is full or FlushInterval expired
+func (s *ContainerLogShipper) nextBatch() []ContainerLogLine {
+	batch := []ContainerLogLine{<-s.lines}
+	flush := time.After(s.FlushInterval)
+	for len(batch) < s.BatchSize {
+		select {
+		case line := <-s.lines:
+			batch = append(batch, line)
+		case <-flush:
+			return batch
+		}
+	}
+	return batch
+}
+
+// splitLogTimestamp splits the timestamp added by docker to a log line
+func splitLogTimestamp(line string) (time.Time, string) {
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[:i]); err == nil {
+			return t, line[i+1:]
+		}
+	}
+	return time.Now(), line
+}
+
+// demuxDockerLogs calls fn for each line of a docker log stream, which is
+// multiplexed with 8 bytes headers unless the container has a tty
+func demuxDockerLogs(r io.Reader, tty bool, fn func(stream, line string)) error {
+	if tty {
+		return scanLogLines(r, func(line string) { fn("stdout", line) })
+	}
+
+	streams := map[byte]string{1: "stdout", 2: "stderr"}
+	partial := map[byte][]byte{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		name, ok := streams[header[0]]
+		if !ok {
+			continue
+		}
+		data := append(partial[header[0]], payload...)
+		for {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				fn(name, string(data[:i]))
+				data = data[i+1:]
+			} else if len(data) > maxDockerLogLine {
+				fn(name, string(data[:maxDockerLogLine]))
+				data = data[maxDockerLogLine:]
+			} else {
+				break
+			}
+		}
+		partial[header[0]] = data
+	}
+}
+
+// scanLogLines calls fn for each line of r, splitting the lines longer than
+// maxDockerLogLine
+func scanLogLines(r io.Reader, fn func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) >= maxDockerLogLine && bytes.IndexByte(data[:maxDockerLogLine], '\n') < 0 {
+			return maxDockerLogLine, data[:maxDockerLogLine], nil
+		}
+		return bufio.ScanLines(data, atEOF)
+	})
+	for scanner.Scan() {
+		fn(strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	return scanner.Err()
+}
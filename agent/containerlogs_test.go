@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func muxFrame(stream byte, data string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func TestDemuxDockerLogs(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(muxFrame(1, "one\ntw"))
+	buf.Write(muxFrame(2, "err\n"))
+	buf.Write(muxFrame(1, "o\n"))
+	var got []string
+	err := demuxDockerLogs(&buf, false, func(stream, line string) {
+		got = append(got, stream+":"+line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"stdout:one", "stderr:err", "stdout:two"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got = nil
+	demuxDockerLogs(bytes.NewBufferString("a\r\nb\n"), true, func(stream, line string) {
+		got = append(got, stream+":"+line)
+	})
+	if expected := []string{"stdout:a", "stdout:b"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// long lines are split at maxDockerLogLine, with or without tty
+	long := strings.Repeat("x", 2*maxDockerLogLine+10)
+	expected = []string{long[:maxDockerLogLine], long[maxDockerLogLine : 2*maxDockerLogLine], long[2*maxDockerLogLine:], "c"}
+	var muxed bytes.Buffer
+	muxed.Write(muxFrame(1, long))
+	muxed.Write(muxFrame(1, "\nc\n"))
+	for _, tty := range []bool{true, false} {
+		stream := &muxed
+		if tty {
+			stream = bytes.NewBufferString(long + "\nc\n")
+		}
+		got = nil
+		err = demuxDockerLogs(stream, tty, func(stream, line string) {
+			got = append(got, line)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("tty %v: expected the long line to be split, got %d lines", tty, len(got))
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(2)
+	for i, expected := range []bool{true, true, false, false} {
+		if r.allow(now) != expected {
+			t.Errorf("line %d: expected %v", i, expected)
+		}
+	}
+	if r.dropped != 2 {
+		t.Errorf("expected 2 dropped lines, got %d", r.dropped)
+	}
+	if !r.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("expected a line to be allowed after half a second")
+	}
+	if !newRateLimiter(0).allow(now) {
+		t.Error("expected no limit with a rate of 0")
+	}
+}
+
+type fakeLogSink struct {
+	batches chan []ContainerLogLine
+	fail    int
+}
+
+func (s *fakeLogSink) Write(lines []ContainerLogLine) error {
+	if s.fail > 0 {
+		s.fail--
+		return fmt.Errorf("sink unavailable")
+	}
+	s.batches <- lines
+	return nil
+}
+
+func TestContainerLogShipper(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	debug := false
+	oldDebug := FlagDebugMode
+	FlagDebugMode = &debug
+	defer func() { FlagDebugMode = oldDebug }()
+
+	base := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	var queries []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Id":"aaa","Names":["/web"],"Image":"nginx","Labels":{"service":"web"}}]`)
+	})
+	mux.HandleFunc("/containers/aaa/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Config":{"Tty":false}}`)
+	})
+	mux.HandleFunc("/containers/aaa/logs", func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		for i := 0; i < 5; i++ {
+			w.Write(muxFrame(1, fmt.Sprintf("%s line %d\n", base.Add(time.Duration(i)*time.Second).Format(time.RFC3339Nano), i)))
+		}
+	})
+	defer serveFakeDocker(t, mux)()
+
+	sink := &fakeLogSink{batches: make(chan []ContainerLogLine, 10), fail: 1}
+	s := NewContainerLogShipper(sink)
+	s.RateLimit = 3
+	s.FlushInterval = 100 * time.Millisecond
+	s.TailLines = 10
+	go s.Ship()
+
+	c := logContainer{ID: "aaa", Names: []string{"/web"}, Image: "nginx", Labels: map[string]string{"service": "web"}}
+	if err := s.followOnce(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []ContainerLogLine
+	timeout := time.After(5 * time.Second)
+	for len(lines) < 3 {
+		select {
+		case batch := <-sink.batches:
+			lines = append(lines, batch...)
+		case <-timeout:
+			t.Fatalf("expected 3 lines to be shipped, got %v", lines)
+		}
+	}
+	if lines[0].Line != "line 0" || lines[0].ContainerName != "web" || lines[0].Image != "nginx" ||
+		lines[0].Labels["service"] != "web" || lines[0].Stream != "stdout" || !lines[0].Time.Equal(base) {
+		t.Errorf("unexpected line %+v", lines[0])
+	}
+	if lines[2].Line != "line 2" {
+		t.Errorf("expected lines over the rate limit to be dropped, got %+v", lines)
+	}
+	if queries[0] != "follow=1&stdout=1&stderr=1&timestamps=1&tail=10" {
+		t.Errorf("unexpected query %q", queries[0])
+	}
+
+	// the stream is resumed after the last line read, skipping the lines
+	// already shipped
+	s.RateLimit = 0
+	if err := s.followOnce(c); err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("follow=1&stdout=1&stderr=1&timestamps=1&since=%d", base.Add(4*time.Second).Unix()); queries[1] != expected {
+		t.Errorf("expected query %q, got %q", expected, queries[1])
+	}
+	select {
+	case batch := <-sink.batches:
+		t.Errorf("expected no line to be shipped again, got %+v", batch)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestContainerLogShipperForgetsRemovedContainers(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("all") != "1" {
+			t.Errorf("expected all the containers to be listed, got %q", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `[{"Id":"stopped","Names":["/web"]}]`)
+	})
+	defer serveFakeDocker(t, mux)()
+
+	s := NewContainerLogShipper(&fakeLogSink{})
+	now := time.Now()
+	s.last = map[string]time.Time{"stopped": now, "removed": now, "followed": now}
+	s.following = map[string]bool{"followed": true}
+	if err := s.forgetRemoved(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.last["removed"]; ok || len(s.last) != 2 {
+		t.Errorf("expected only the removed container to be forgotten, got %v", s.last)
+	}
+}
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// restart policies under which docker restarts containers by itself when
+// the daemon starts
+var selfRestartPolicies = map[string]bool{
+	"always":         true,
+	"unless-stopped": true,
+}
+
+// SnapshotContainer is a container to start again after a docker restart
+type SnapshotContainer struct {
+	ID   string
+	Name string
+}
+
+// ContainerSnapshot lists the containers running before a docker restart
+// initiated by the agent, which docker's restart policy will not bring back
+type ContainerSnapshot []SnapshotContainer
+
+// SnapshotContainers lists the running containers without a restart policy
+// bringing them back. An empty snapshot is returned if docker does not answer.
+func SnapshotContainers() ContainerSnapshot {
+	snapshot, err := snapshotContainers(DialTimeOut * time.Second)
+	if err != nil {
+		SendError(err, "Failed to list the running containers", nil)
+		Logger.Println("Cannot list the running containers, they will not be restarted:", err)
+		return nil
+	}
+	if len(snapshot) > 0 {
+		Logger.Printf("%d running containers will be started again after the docker restart", len(snapshot))
+	}
+	return snapshot
+}
+
+func snapshotContainers(timeout time.Duration) (ContainerSnapshot, error) {
+	body, err := dockerAPIGet("/containers/json", timeout)
+	if err != nil {
+		return nil, err
+	}
+	var containers []struct {
+		Id    string
+		Names []string
+	}
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return nil, err
+	}
+
+	var snapshot ContainerSnapshot
+	for _, container := range containers {
+		body, err := dockerAPIGet("/containers/"+container.Id+"/json", timeout)
+		if err != nil {
+			// the container may have been removed since it was listed
+			Logger.Printf("Cannot inspect container %s, it will not be restarted: %s", container.Id, err)
+			continue
+		}
+		var inspect struct {
+			HostConfig struct {
+				RestartPolicy struct {
+					Name string
+				}
+			}
+		}
+		if err := json.Unmarshal(body, &inspect); err != nil {
+			return nil, err
+		}
+		if selfRestartPolicies[inspect.HostConfig.RestartPolicy.Name] {
+			continue
+		}
+		name := container.Id
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		snapshot = append(snapshot, SnapshotContainer{ID: container.Id, Name: name})
+	}
+	return snapshot, nil
+}
+
+// Restore starts the containers of the snapshot, once docker is healthy
+// again, and reports the ones which failed to start
+func (s ContainerSnapshot) Restore() {
+	failures := s.restore(DialTimeOut * time.Second)
+	if len(failures) == 0 {
+		if len(s) > 0 {
+			Logger.Printf("Started %d containers again after the docker restart", len(s))
+		}
+		return
+	}
+	for name, err := range failures {
+		Logger.Printf("Cannot start container %s again after the docker restart: %s", name, err)
+	}
+	SendError(fmt.Errorf("%d containers failed to start after the docker restart", len(failures)),
+		"Failed to start containers after docker restart", map[string]interface{}{"containers": failures})
+}
+
+func (s ContainerSnapshot) restore(timeout time.Duration) map[string]string {
+	failures := map[string]string{}
+	for _, container := range s {
+		if _, err := dockerAPIPost("/containers/"+container.ID+"/start", timeout); err != nil {
+			failures[container.Name] = err.Error()
+		}
+	}
+	return failures
+}
+
+// savedContainerSnapshot is a snapshot saved for the next agent, along
+// with the boot it was taken in
+type savedContainerSnapshot struct {
+	BootID     string
+	Containers ContainerSnapshot
+}
+
+// path of the kernel boot id, overridable by tests
+var bootIDFile = path.Join(procDir, "sys/kernel/random/boot_id")
+
+func readBootID() string {
+	data, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Save writes the snapshot to file, so that the containers are started
+// again by the next agent when it restarts docker
+func (s ContainerSnapshot) Save(file string) error {
+	data, err := json.Marshal(savedContainerSnapshot{BootID: readBootID(), Containers: s})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// loadSavedContainers reads and removes the snapshot saved by the previous
+// agent. The snapshot is dropped if the host rebooted since, as the agent
+// only restarts containers after the docker restarts it initiated, and
+// containers which were not meant to survive a reboot stay stopped.
+func loadSavedContainers(file string) (ContainerSnapshot, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil
+	}
+	os.RemoveAll(file)
+	var saved savedContainerSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	if bootID := readBootID(); saved.BootID == "" || saved.BootID != bootID {
+		Logger.Println("Host rebooted since the containers were saved, leaving them to their restart policy")
+		return nil, nil
+	}
+	return saved.Containers, nil
+}
+
+// RestoreSavedContainers starts the containers saved by the previous agent
+// when it stopped docker, once the new daemon is healthy
+func RestoreSavedContainers(file string) {
+	snapshot, err := loadSavedContainers(file)
+	if err != nil {
+		Logger.Println("Cannot read the containers saved by the previous agent:", err)
+		return
+	}
+	if len(snapshot) == 0 {
+		return
+	}
+	if err := waitEngineHealthy(Docker, upgradeHealthTimeout); err != nil {
+		SendError(err, "Docker is not healthy, cannot start the saved containers", nil)
+		Logger.Println("Cannot start the containers saved by the previous agent:", err)
+		return
+	}
+	snapshot.Restore()
+}
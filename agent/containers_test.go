@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// serveFakeDocker serves handler on a unix socket used as DockerDefaultHost
+func serveFakeDocker(t *testing.T, handler http.Handler) func() {
+	dir, err := ioutil.TempDir("", "containers-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHost := DockerDefaultHost
+	DockerDefaultHost = "unix://" + path.Join(dir, "docker.sock")
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	return func() {
+		server.Close()
+		DockerDefaultHost = oldHost
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSnapshotAndRestoreContainers(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	policies := map[string]string{
+		"aaa": "",
+		"bbb": "always",
+		"ccc": "no",
+		"ddd": "unless-stopped",
+		"eee": "on-failure",
+	}
+	var mutex sync.Mutex
+	var started []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Id":"aaa","Names":["/web"]},{"Id":"bbb","Names":["/db"]},{"Id":"ccc","Names":["/worker"]},`+
+			`{"Id":"ddd","Names":["/cache"]},{"Id":"eee","Names":[]},{"Id":"fff","Names":["/removed"]}]`)
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")
+		switch {
+		case r.Method == "GET" && parts[1] == "json" && parts[0] == "fff":
+			// removed between the list and the inspect
+			http.Error(w, "no such container", http.StatusNotFound)
+		case r.Method == "GET" && parts[1] == "json":
+			fmt.Fprintf(w, `{"HostConfig":{"RestartPolicy":{"Name":%q}}}`, policies[parts[0]])
+		case r.Method == "POST" && parts[1] == "start":
+			mutex.Lock()
+			started = append(started, parts[0])
+			mutex.Unlock()
+			switch parts[0] {
+			case "ccc":
+				w.WriteHeader(http.StatusNotModified)
+			case "eee":
+				http.Error(w, "port is already allocated", http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer serveFakeDocker(t, mux)()
+
+	snapshot, err := snapshotContainers(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ContainerSnapshot{{"aaa", "web"}, {"ccc", "worker"}, {"eee", "eee"}}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Fatalf("Expected %v, got %v", expected, snapshot)
+	}
+
+	failures := snapshot.restore(time.Second)
+	if !reflect.DeepEqual(started, []string{"aaa", "ccc", "eee"}) {
+		t.Fatal("Unexpected started containers:", started)
+	}
+	if len(failures) != 1 || !strings.Contains(failures["eee"], "port is already allocated") {
+		t.Fatal("Expected the failure of eee to be reported, got", failures)
+	}
+}
+
+func TestSnapshotContainersWithoutDocker(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	oldHost := DockerDefaultHost
+	DockerDefaultHost = "unix:///nonexistent/docker.sock"
+	defer func() { DockerDefaultHost = oldHost }()
+
+	if snapshot := SnapshotContainers(); len(snapshot) != 0 {
+		t.Fatal("Expected an empty snapshot, got", snapshot)
+	}
+}
+
+func TestContainerSnapshotSave(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "containers-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { bootIDFile = file }(bootIDFile)
+	bootIDFile = path.Join(dir, "boot_id")
+	ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+
+	file := path.Join(dir, "containers.json")
+	snapshot := ContainerSnapshot{{"aaa", "web"}}
+	if err := snapshot.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"BootID":"boot-1","Containers":[{"ID":"aaa","Name":"web"}]}` {
+		t.Fatalf("Unexpected saved snapshot %s", data)
+	}
+	if loaded, err := loadSavedContainers(file); err != nil || !reflect.DeepEqual(loaded, snapshot) {
+		t.Fatalf("Expected %v to be loaded, got %v (%v)", snapshot, loaded, err)
+	}
+	if utils.FileExist(file) {
+		t.Fatal("Expected the saved snapshot to be removed once loaded")
+	}
+
+	// containers saved before a reboot are left to their restart policy
+	if err := snapshot.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(bootIDFile, []byte("boot-2\n"), 0644)
+	if loaded, err := loadSavedContainers(file); err != nil || len(loaded) != 0 {
+		t.Fatalf("Expected nothing to be loaded after a reboot, got %v (%v)", loaded, err)
+	}
+}
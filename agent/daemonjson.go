@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// daemonFlagKeys maps docker daemon flags to their daemon.json keys, when
+// the key is not simply the flag name without its leading dashes
+var daemonFlagKeys = map[string]string{
+	"-H":                     "hosts",
+	"--host":                 "hosts",
+	"-D":                     "debug",
+	"-s":                     "storage-driver",
+	"--storage-opt":          "storage-opts",
+	"-g":                     "graph",
+	"--registry-mirror":      "registry-mirrors",
+	"--insecure-registry":    "insecure-registries",
+	"--log-opt":              "log-opts",
+	"-b":                     "bridge",
+	"--label":                "labels",
+	"-l":                     "log-level",
+	"-G":                     "group",
+	"-p":                     "pidfile",
+	"--exec-opt":             "exec-opts",
+	"--dns-opt":              "dns-opts",
+	"--dns-search":           "dns-search",
+	"--authorization-plugin": "authorization-plugins",
+}
+
+// DockerConfigConflict is a setting found both in the daemon.json file and
+// on the docker command line, which makes the daemon refuse to start
+type DockerConfigConflict struct {
+	Key       string
+	FileValue interface{}
+	Flag      string
+}
+
+func (c DockerConfigConflict) String() string {
+	return fmt.Sprintf("%s (file value %v, flag %s)", c.Key, c.FileValue, c.Flag)
+}
+
+// getDockerDaemonConfig renders the typed docker settings into daemon.json keys
+func getDockerDaemonConfig(conf Configuration, caps DockerCapabilities) map[string]interface{} {
+	config := map[string]interface{}{}
+	if conf.DockerStorageDriver != "" {
+		config["storage-driver"] = conf.DockerStorageDriver
+	}
+	if len(conf.DockerStorageOpts) > 0 {
+		config["storage-opts"] = conf.DockerStorageOpts
+	}
+	if conf.DockerGraph != "" {
+		if caps.Supports(CapDataRoot) {
+			config["data-root"] = conf.DockerGraph
+		} else {
+			config["graph"] = conf.DockerGraph
+		}
+	}
+	if len(conf.DockerRegistryMirrors) > 0 {
+		config["registry-mirrors"] = conf.DockerRegistryMirrors
+	}
+	if len(conf.DockerInsecureRegistries) > 0 {
+		config["insecure-registries"] = conf.DockerInsecureRegistries
+	}
+	if len(conf.DockerDNS) > 0 {
+		config["dns"] = conf.DockerDNS
+	}
+	if conf.DockerLogDriver != "" {
+		config["log-driver"] = conf.DockerLogDriver
+	}
+	if len(conf.DockerLogOpts) > 0 {
+		config["log-opts"] = conf.DockerLogOpts
+	}
+	if conf.DockerBridge != "" {
+		config["bridge"] = conf.DockerBridge
+	}
+	if conf.DockerBip != "" {
+		config["bip"] = conf.DockerBip
+	}
+	if len(conf.DockerLabels) > 0 {
+		config["labels"] = conf.DockerLabels
+	}
+	if conf.DockerLiveRestore && caps.Supports(CapLiveRestore) {
+		config["live-restore"] = true
+	}
+	return config
+}
+
+// loadDaemonConfigBase reads the user-supplied daemon.json, a missing file
+// being equivalent to an empty one
+func loadDaemonConfigBase(baseFile string) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	if baseFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(baseFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return config, nil
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.New("Failed to parse " + baseFile + ": " + err.Error())
+	}
+	return config, nil
+}
+
+// mergeDaemonConfig overlays the agent settings on top of the base file.
+// Agent settings win, and the keys whose value got replaced are returned.
+func mergeDaemonConfig(base, agent map[string]interface{}) (map[string]interface{}, []string) {
+	merged := map[string]interface{}{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	var overridden []string
+	for key, value := range agent {
+		if baseValue, ok := base[key]; ok && !sameConfigValue(baseValue, value) {
+			overridden = append(overridden, key)
+		}
+		merged[key] = value
+	}
+	sort.Strings(overridden)
+	return merged, overridden
+}
+
+func sameConfigValue(a, b interface{}) bool {
+	// compare through json, as the base file is decoded into generic types
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(ja) == string(jb)
+}
+
+// daemonFlagKey returns the daemon.json key of a command line argument, or
+// an empty string if the argument is not a flag
+func daemonFlagKey(arg string) string {
+	if !strings.HasPrefix(arg, "-") {
+		return ""
+	}
+	name := strings.SplitN(arg, "=", 2)[0]
+	if key, ok := daemonFlagKeys[name]; ok {
+		return key
+	}
+	if strings.HasPrefix(name, "--") {
+		return name[2:]
+	}
+	return ""
+}
+
+// findDaemonConfigConflicts lists the daemon.json keys also set by flags
+func findDaemonConfigConflicts(config map[string]interface{}, flags []string) []DockerConfigConflict {
+	var conflicts []DockerConfigConflict
+	seen := map[string]bool{}
+	for _, flag := range flags {
+		key := daemonFlagKey(flag)
+		if key == "" || seen[key] {
+			continue
+		}
+		if value, ok := config[key]; ok {
+			seen[key] = true
+			conflicts = append(conflicts, DockerConfigConflict{Key: key, FileValue: value, Flag: flag})
+		}
+	}
+	return conflicts
+}
+
+// writeDockerDaemonConfig generates the daemon.json owned by the agent from
+// the base file and the typed settings. Settings which conflict with the
+// given command line flags are reported and dropped from the file, as the
+// docker daemon refuses to start otherwise.
+func writeDockerDaemonConfig(configFile, baseFile string, conf Configuration, caps DockerCapabilities, flags []string) error {
+	base, err := loadDaemonConfigBase(baseFile)
+	if err != nil {
+		return err
+	}
+	merged, overridden := mergeDaemonConfig(base, getDockerDaemonConfig(conf, caps))
+	for _, key := range overridden {
+		Logger.Printf("Docker setting '%s' in %s is overridden by the agent configuration", key, baseFile)
+	}
+
+	conflicts := findDaemonConfigConflicts(merged, flags)
+	if len(conflicts) > 0 {
+		var keys []string
+		for _, conflict := range conflicts {
+			Logger.Println("Docker setting conflicts with a command line flag, dropping it from daemon.json:", conflict)
+			keys = append(keys, conflict.Key)
+			delete(merged, conflict.Key)
+		}
+		extra := map[string]interface{}{"conflicts": keys}
+		SendError(errors.New("daemon.json conflicts with command line flags"), "Docker configuration conflict", extra)
+	}
+
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configFile, data, 0644)
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestMergeDaemonConfig(t *testing.T) {
+	base := map[string]interface{}{
+		"dns":            []interface{}{"8.8.8.8"},
+		"storage-driver": "devicemapper",
+		"live-restore":   true,
+	}
+	agent := map[string]interface{}{
+		"dns":            []string{"8.8.8.8"},
+		"storage-driver": "overlay",
+	}
+	merged, overridden := mergeDaemonConfig(base, agent)
+	if len(overridden) != 1 || overridden[0] != "storage-driver" {
+		t.Fatal("Expected only storage-driver to be overridden, got", overridden)
+	}
+	if merged["storage-driver"] != "overlay" || merged["live-restore"] != true {
+		t.Fatal("Unexpected merged config:", merged)
+	}
+}
+
+func TestFindDaemonConfigConflicts(t *testing.T) {
+	config := map[string]interface{}{
+		"hosts":        []interface{}{"tcp://0.0.0.0:2376"},
+		"tlsverify":    true,
+		"live-restore": true,
+		"debug":        true,
+	}
+	flags := []string{"daemon", "-H", "unix:///var/run/docker.sock", "-H", "tcp://0.0.0.0:2375",
+		"--tlscert", "cert.pem", "--tlsverify", "--userland-proxy=false", "-D"}
+	conflicts := findDaemonConfigConflicts(config, flags)
+	if len(conflicts) != 3 {
+		t.Fatal("Expected 3 conflicts, got", conflicts)
+	}
+	for i, key := range []string{"hosts", "tlsverify", "debug"} {
+		if conflicts[i].Key != key {
+			t.Errorf("Expected conflict on %s, got %s", key, conflicts[i].Key)
+		}
+	}
+}
+
+func TestWriteDockerDaemonConfig(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "daemonjson-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseFile := path.Join(dir, "base.json")
+	configFile := path.Join(dir, "daemon.json")
+	if err := ioutil.WriteFile(baseFile, []byte(`{"hosts": ["fd://"], "live-restore": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := semver.Make("1.12.0")
+	conf := Configuration{DockerLogDriver: "syslog"}
+	if err := writeDockerDaemonConfig(configFile, baseFile, conf, GetDockerCapabilities(v), []string{"-H", "unix:///var/run/docker.sock"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config["hosts"]; ok {
+		t.Fatal("Expected conflicting hosts to be dropped")
+	}
+	if config["live-restore"] != true || config["log-driver"] != "syslog" {
+		t.Fatal("Unexpected daemon config:", config)
+	}
+}
@@ -1,143 +1,154 @@
 package agent
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
-	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"code.google.com/p/go-shlex"
-	"github.com/blang/semver"
 	"github.com/tutumcloud/tutum-agent/utils"
 )
 
+// time given to a restarted docker daemon to pass its health check
+var upgradeHealthTimeout = DockerUpgradeHealthTimeout * time.Second
+
+// DownloadDocker installs docker if missing, either as a single binary or
+// from a .tgz bundle with dockerd, containerd and runc
 func DownloadDocker(url, dockerBinPath string) {
-	if !utils.FileExist(dockerBinPath) {
+	downloadPath := dockerBinPath + ".download"
+	for i := 1; !utils.FileExist(dockerBinPath); i *= 2 {
+		if i > MaxWaitingTime {
+			i = 1
+		}
 		Logger.Println("Downloading docker binary...")
-		downloadFile(url, dockerBinPath, "docker")
+		downloadFile(url, downloadPath, "docker")
+		if err := installDockerFile(downloadPath, dockerBinPath, false); err != nil {
+			SendError(err, "Failed to install docker", nil)
+			Logger.Printf("Failed to install docker: %s. Retrying in %d second", err, i)
+			os.RemoveAll(downloadPath)
+			time.Sleep(time.Duration(i) * time.Second)
+		}
 	}
 	createDockerSymlink(dockerBinPath, DockerSymbolicLink)
 }
 
-func getDockerClientVersion(dockerBinPath string) (version string) {
-	var versionStr string
-	out, err := exec.Command("docker", "-v").Output()
-	if err != nil {
-		SendError(err, "Failed to get the docker version", nil)
-	}
-	versionStr = string(out)
-
-	if versionStr != "" {
-		re := regexp.MustCompile("(\\d+\\.\\d+)\\.\\d+")
-		match := re.FindStringSubmatch(versionStr)
-		if match != nil && len(match) > 0 {
-			version = match[0]
-		}
-	}
-	Logger.Print("Found docker: version ", version)
-	return
+// getDockerStartCommand returns the binary and the arguments starting the
+// docker daemon installed at dockerBinPath, according to its version
+func getDockerStartCommand(dockerBinPath, keyFilePath, certFilePath, caFilePath string) (string, []string) {
+	caps := GetDockerCapabilities(getDockerVersion(dockerBinPath))
+	bin, args := caps.DaemonCommand(dockerBinPath)
+	return bin, append(args, getDockerStartOpt(caps, keyFilePath, certFilePath, caFilePath)...)
 }
 
-func getDockerStartOpt(dockerBinPath, keyFilePath, certFilePath, caFilePath string) []string {
-	ver := getDockerClientVersion(dockerBinPath)
-	v, err := semver.Make(ver)
-	if err != nil {
-		Logger.Println("Cannot get semantic version of", ver)
-	}
-	v1_7, err := semver.Make("1.7.0")
-	v1_8, err := semver.Make("1.8.0")
-
-	daemonOpt := "daemon"
-	if v.LT(v1_8) {
-		daemonOpt = "-d"
-	}
-
-	userlandProxyOpt := ""
-	if v.GTE(v1_7) {
-		userlandProxyOpt = " --userland-proxy=false"
-	}
-
-	debugOpt := ""
+func getDockerStartOpt(caps DockerCapabilities, keyFilePath, certFilePath, caFilePath string) []string {
+	var optSlice []string
 	if *FlagDebugMode {
-		debugOpt = " -D"
+		optSlice = append(optSlice, "-D")
 	}
 
-	bindOpt := fmt.Sprintf(" -H %s -H %s", DockerDefaultHost, Conf.DockerHost)
-
-	var certOpt string
-	if *FlagStandalone && !utils.FileExist(caFilePath) {
-		certOpt = fmt.Sprintf(" --tlscert %s --tlskey %s --tls", certFilePath, keyFilePath)
-		fmt.Fprintln(os.Stderr, "WARNING: standalone mode activated but no CA certificate found - client authentication disabled")
+	if len(DockerActivatedSockets) > 0 {
+		optSlice = append(optSlice, "-H", "fd://", "-H", Conf.DockerHost)
 	} else {
-		certOpt = fmt.Sprintf(" --tlscert %s --tlskey %s --tlscacert %s --tlsverify", certFilePath, keyFilePath, caFilePath)
+		optSlice = append(optSlice, "-H", DockerDefaultHost, "-H", Conf.DockerHost)
 	}
 
-	extraOpt := ""
-	if Conf.DockerOpts != "" {
-		extraOpt = " " + Conf.DockerOpts
+	if DockerPidFile != defaultDockerPidFile {
+		optSlice = append(optSlice, "--pidfile="+DockerPidFile)
+	}
+	if Conf.DockerGraph == "" && DockerDataRoot != defaultDockerDataRoot {
+		if caps.Supports(CapDataRoot) {
+			optSlice = append(optSlice, "--data-root="+DockerDataRoot)
+		} else {
+			optSlice = append(optSlice, "--graph="+DockerDataRoot)
+		}
 	}
 
-	optStr := fmt.Sprintf("%s%s%s%s%s%s", daemonOpt, debugOpt, bindOpt, userlandProxyOpt, certOpt, extraOpt)
-
-	optSlice, err := shlex.Split(optStr)
-	if err != nil {
-		optSlice = strings.Split(optStr, " ")
+	if caps.Supports(CapUserlandProxy) {
+		optSlice = append(optSlice, "--userland-proxy=false")
 	}
-	return optSlice
-}
 
-func StartDocker(dockerBinPath, keyFilePath, certFilePath, caFilePath string) {
-	optSlice := getDockerStartOpt(dockerBinPath, keyFilePath, certFilePath, caFilePath)
-	command := exec.Command(dockerBinPath, optSlice...)
-	go runDocker(command)
-}
+	optSlice = append(optSlice, getDockerTLSOpt(keyFilePath, certFilePath, caFilePath)...)
 
-func StopDocker() {
-	if DockerProcess != nil {
-		DockerProcess.Signal(syscall.SIGTERM)
-		for {
-			if DockerProcess != nil {
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				break
-			}
+	extraOpt := getDockerExtraOpts(Conf)
+
+	if caps.Supports(CapConfigFile) {
+		configFile := path.Join(TutumHome, DockerDaemonConfigName)
+		baseFile := Conf.DockerDaemonConfigBase
+		if baseFile == "" {
+			baseFile = defaultDockerDaemonConfigBase
+		}
+		flags := append(append([]string{}, optSlice...), extraOpt...)
+		if err := writeDockerDaemonConfig(configFile, baseFile, Conf, caps, flags); err != nil {
+			SendError(err, "Failed to write docker daemon.json", nil)
+			Logger.Println("Cannot write docker daemon.json, passing settings as flags:", err)
+			optSlice = append(optSlice, getDockerConfigOpts(Conf, caps)...)
+		} else {
+			optSlice = append(optSlice, "--config-file="+configFile)
 		}
+	} else {
+		optSlice = append(optSlice, getDockerConfigOpts(Conf, caps)...)
 	}
+
+	return append(optSlice, extraOpt...)
 }
 
-func UpdateDocker(dockerBinPath, dockerNewBinPath, dockerNewBinSigPath, keyFilePath, certFilePath, caFilePath string) {
+// UpdateDocker applies the docker binary staged at dockerNewBinPath, once a
+// maintenance window opens or when "tutum-agent docker upgrade-now" is called
+func UpdateDocker(engine Engine, dockerNewBinPath, dockerNewBinSigPath, dockerUpgradeNowPath string) {
 	if utils.FileExist(dockerNewBinPath) {
+		if !dockerUpgradeAllowed(dockerUpgradeNowPath, time.Now()) {
+			return
+		}
+		dockerLifecycle.Lock()
+		defer dockerLifecycle.Unlock()
 		Logger.Printf("New Docker binary (%s) found", dockerNewBinPath)
 		Logger.Println("Updating docker...")
 		if verifyDockerSig(dockerNewBinPath, dockerNewBinSigPath) {
+			snapshot := SnapshotContainers()
 			Logger.Println("Stopping docker daemon")
-			ScheduleToTerminateDocker = true
-			StopDocker()
-			Logger.Println("Removing old docker binary")
-			if err := os.RemoveAll(dockerBinPath); err != nil {
-				SendError(err, "Failed to remove the old docker binary", nil)
-				Logger.Println("Cannot remove old docker binary:", err)
-			}
-			Logger.Println("Renaming new docker binary")
-			if err := os.Rename(dockerNewBinPath, dockerBinPath); err != nil {
-				SendError(err, "Failed to rename the docker binary", nil)
-				Logger.Println("Cannot rename docker binary:", err)
+			engine.Stop()
+			Logger.Println("Installing new docker, keeping old docker binaries")
+			if err := engine.Install(dockerNewBinPath); err != nil {
+				SendError(err, "Failed to install the new docker", nil)
+				Logger.Println("Cannot install new docker, restarting the current one:", err)
+				os.RemoveAll(dockerNewBinPath)
+				os.RemoveAll(dockerNewBinSigPath)
+				engine.Start()
+				if err := waitEngineHealthy(engine, upgradeHealthTimeout); err != nil {
+					Logger.Println("Docker daemon is not healthy after the failed upgrade:", err)
+					return
+				}
+				snapshot.Restore()
+				return
 			}
 			Logger.Println("Removing the signature file", dockerNewBinSigPath)
 			if err := os.RemoveAll(dockerNewBinSigPath); err != nil {
 				SendError(err, "Failed to remove the docker sig file", nil)
 				Logger.Println(err)
 			}
-			createDockerSymlink(dockerBinPath, DockerSymbolicLink)
-			ScheduleToTerminateDocker = false
-			StartDocker(dockerBinPath, keyFilePath, certFilePath, caFilePath)
+			engine.Start()
+
+			Logger.Println("Checking the health of the new docker daemon")
+			if err := waitEngineHealthy(engine, upgradeHealthTimeout); err != nil {
+				extra := map[string]interface{}{"docker-log": tailDockerLog()}
+				SendError(err, "Docker failed the health check after upgrade, rolling back", extra)
+				Logger.Println("New docker daemon is not healthy, rolling back:", err)
+				if err := rollbackDocker(engine, snapshot); err != nil {
+					SendError(err, "Failed to roll back docker", nil)
+					Logger.Println("Failed to roll back docker:", err)
+				}
+				return
+			}
 			Logger.Println("Docker binary updated successfully")
+			snapshot.Restore()
 		} else {
 			Logger.Println("Cannot verify signature. Rejecting update")
 			Logger.Println("Removing the invalid docker binary", dockerNewBinPath)
@@ -152,33 +163,140 @@ func UpdateDocker(dockerBinPath, dockerNewBinPath, dockerNewBinSigPath, keyFileP
 			}
 			Logger.Println("Failed to update docker binary")
 		}
+	} else {
+		dockerUpgradeGone()
 	}
 }
 
-func verifyDockerSig(dockerNewBinPath, dockerNewBinSigPath string) bool {
-	cmd := exec.Command("gpg", "--verify", dockerNewBinSigPath, dockerNewBinPath)
-	err := cmd.Run()
-	if err != nil {
-		SendError(err, "GPG verification failed", nil)
-		Logger.Println("GPG verification failed:", err)
-		return false
+// RollbackDocker restores the docker binaries used before the last upgrade
+// and restarts the engine
+func RollbackDocker(engine Engine) error {
+	dockerLifecycle.Lock()
+	defer dockerLifecycle.Unlock()
+	var snapshot ContainerSnapshot
+	if engine.State() == DockerRunning {
+		snapshot = SnapshotContainers()
+	}
+	return rollbackDocker(engine, snapshot)
+}
+
+// rollbackDocker rolls docker back, and starts the containers of snapshot
+// again once the previous daemon is healthy
+func rollbackDocker(engine Engine, snapshot ContainerSnapshot) error {
+	Logger.Println("Stopping docker daemon")
+	engine.Stop()
+
+	Logger.Println("Restoring previous docker binary")
+	if err := engine.Rollback(); err != nil {
+		engine.Start()
+		return err
+	}
+
+	engine.Start()
+	if err := waitEngineHealthy(engine, upgradeHealthTimeout); err != nil {
+		return errors.New("docker is not healthy after rollback: " + err.Error())
+	}
+	snapshot.Restore()
+	Logger.Println("Docker binary rolled back successfully")
+	return nil
+}
+
+// DockerCommand handles "tutum-agent docker rollback" and "tutum-agent
+// docker upgrade-now", and exits. The rollback is delegated to the running
+// agent if there is one.
+func DockerCommand(dockerBinPath, dockerNewBinPath, dockerPrevBinPath, dockerRollbackPath, dockerUpgradeNowPath string) {
+	if flag.NArg() == 0 || flag.Arg(0) != "docker" {
+		return
+	}
+	if flag.NArg() != 2 || (flag.Arg(1) != "rollback" && flag.Arg(1) != "upgrade-now") {
+		flag.Usage()
+		os.Exit(1)
 	}
-	Logger.Println("GPG verification passed")
-	return true
+	if flag.Arg(1) == "upgrade-now" {
+		if !utils.FileExist(dockerNewBinPath) {
+			fmt.Fprintln(os.Stderr, "No staged docker upgrade found at", dockerNewBinPath)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(dockerUpgradeNowPath, []byte{}, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot request docker upgrade:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Docker upgrade requested, it will be applied by tutum-agent regardless of maintenance windows")
+		os.Exit(0)
+	}
+	if !utils.FileExist(dockerPrevBinPath) {
+		fmt.Fprintln(os.Stderr, "No previous docker binary found at", dockerPrevBinPath)
+		os.Exit(1)
+	}
+	if isAgentRunning(TutumPidFile) {
+		if err := ioutil.WriteFile(dockerRollbackPath, []byte{}, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot request docker rollback:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Docker rollback requested, it will be performed by the running tutum-agent")
+		os.Exit(0)
+	}
+	engine := &DockerEngine{BinPath: dockerBinPath}
+	if err := engine.Rollback(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to roll back docker:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Docker binary rolled back successfully")
+	os.Exit(0)
+}
+
+// RollbackDockerIfRequested performs the rollback requested by the
+// "tutum-agent docker rollback" command
+func RollbackDockerIfRequested(engine Engine, dockerRollbackPath string) {
+	if !utils.FileExist(dockerRollbackPath) {
+		return
+	}
+	Logger.Println("Docker rollback requested")
+	os.RemoveAll(dockerRollbackPath)
+	if err := RollbackDocker(engine); err != nil {
+		SendError(err, "Failed to roll back docker", nil)
+		Logger.Println("Failed to roll back docker:", err)
+	}
+}
+
+func verifyDockerSig(dockerNewBinPath, dockerNewBinSigPath string) bool {
+	return verifyFileSignature("docker", dockerNewBinPath, dockerNewBinSigPath) == nil
 }
 
 func createDockerSymlink(dockerBinPath, dockerSymbolicLink string) {
-	if err := os.RemoveAll(DockerSymbolicLink); err != nil {
+	if err := os.RemoveAll(dockerSymbolicLink); err != nil {
 		SendError(err, "Failed to remove the old docker symbolic link", nil)
 		Logger.Println(err)
 	}
-	if err := os.Symlink(dockerBinPath, DockerSymbolicLink); err != nil {
+	if err := os.Symlink(dockerBinPath, dockerSymbolicLink); err != nil {
 		SendError(err, "Failed to create docker symbolic link", nil)
 		Logger.Println(err)
 	}
 }
 
-func runDocker(cmd *exec.Cmd) {
+// getDockerExtraOpts splits DockerOpts into flags, appended last
+func getDockerExtraOpts(conf Configuration) []string {
+	if conf.DockerOpts == "" {
+		return nil
+	}
+	opts, err := shlex.Split(conf.DockerOpts)
+	if err != nil {
+		return strings.Fields(conf.DockerOpts)
+	}
+	return opts
+}
+
+func getDockerTLSOpt(keyFilePath, certFilePath, caFilePath string) []string {
+	if *FlagStandalone && !utils.FileExist(caFilePath) {
+		fmt.Fprintln(os.Stderr, "WARNING: standalone mode activated but no CA certificate found - client authentication disabled")
+		return []string{"--tlscert", certFilePath, "--tlskey", keyFilePath, "--tls"}
+	}
+	return []string{"--tlscert", certFilePath, "--tlskey", keyFilePath, "--tlscacert", caFilePath, "--tlsverify"}
+}
+
+// runDocker starts the docker daemon, calls started with its process and
+// blocks until it exits
+func runDocker(cmd *exec.Cmd, started func(*os.Process)) error {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		SendError(err, "Failed to get docker piped stdout", nil)
@@ -192,98 +310,66 @@ func runDocker(cmd *exec.Cmd) {
 		Logger.Println("Cannotget docker piped stdout")
 	}
 
-	//open file to log docker logs
-	dockerLog := path.Join(LogDir, DockerLogFileName)
-	f, err := os.OpenFile(dockerLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		SendError(err, "Failed to set docker log file", nil)
-		Logger.Println(err)
-		Logger.Println("Cannot set docker log to", dockerLog)
-	} else {
-		go io.Copy(f, stdout)
-		go io.Copy(f, stderr)
-		defer f.Close()
-	}
+	dockerLog := getDockerLog()
+	go copyDockerLog(dockerLog, stdout)
+	go copyDockerLog(dockerLog, stderr)
 
 	Logger.Println("Starting docker daemon:", cmd.Args)
 	if err := cmd.Start(); err != nil {
 		SendError(err, "Failed to start docker daemon", nil)
 		Logger.Println("Cannot start docker daemon:", err)
+		return err
 	}
-	DockerProcess = cmd.Process
-	Logger.Printf("Docker daemon (PID:%d) has been started", DockerProcess.Pid)
+	pid := cmd.Process.Pid
+	Logger.Printf("Docker daemon (PID:%d) has been started", pid)
+	started(cmd.Process)
 
-	syscall.Setpriority(syscall.PRIO_PROCESS, DockerProcess.Pid, RenicePriority)
+	exit_renice := make(chan int, 1)
 
-	exit_renice := make(chan int)
-
-	go decreaseDockerChildProcessPriority(exit_renice)
+	if !IsUnprivileged() {
+		placeDockerInCgroup(pid)
+		go manageDockerProcesses(pid, exit_renice)
+	}
 
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	if err != nil {
 		Logger.Println("Docker daemon died with error:", err)
-		out, tailErr := exec.Command("tail", "-n", "10", dockerLog).Output()
-		if tailErr != nil {
-			SendError(tailErr, "Failed to tail docker logs when docker terminates unexpectedly", nil)
-			Logger.Printf("Failed to tail docker logs when docker terminates unexpectedly: %s", err)
-			SendError(err, "Docker daemon terminates unexpectedly", nil)
-		} else {
-			extra := map[string]interface{}{"docker-log": string(out)}
-			SendError(err, "Docker daemon terminates unexpectedly", extra)
-			Logger.Printf("\n=======DOCKER LOGS BEGIN========\n%s=======DOCKER LOGS END========\n", string(out))
-		}
 	} else {
 		Logger.Print("Docker daemon exited")
 	}
 	exit_renice <- 1
-	DockerProcess = nil
+	return err
 }
 
-func decreaseDockerChildProcessPriority(exit_renice chan int) {
-	for {
-		select {
-		case <-exit_renice:
-			return
-		default:
-			out, err := exec.Command("ps", "axo", "pid,ppid,ni").Output()
-			if err != nil {
-				SendError(err, "Failed to run ps command", nil)
-				time.Sleep(ReniceSleepTime * time.Second)
-				continue
-			}
-			lines := strings.Split(string(out), "\n")
-			ppids := []int{DockerProcess.Pid}
-			for _, line := range lines {
-				items := strings.Fields(line)
-				if len(items) != 3 {
-					continue
-				}
-				pid, err := strconv.Atoi(items[0])
-				if err != nil {
-					continue
-				}
-				ppid, err := strconv.Atoi(items[1])
-				if err != nil {
-					continue
-				}
-				ni, err := strconv.Atoi(items[2])
-				if err != nil {
-					continue
-				}
-				if ni != RenicePriority {
-					continue
-				}
-				if pid == DockerProcess.Pid {
-					continue
-				}
-				for _, _ppid := range ppids {
-					if ppid == _ppid {
-						syscall.Setpriority(syscall.PRIO_PROCESS, pid, 0)
-						ppids = append(ppids, pid)
-						break
-					}
-				}
-			}
-			time.Sleep(ReniceSleepTime * time.Second)
+func copyDockerLog(dockerLog *DockerLog, r io.Reader) {
+	if _, err := io.Copy(dockerLog, r); err != nil {
+		SendError(err, "Failed to write docker logs", nil)
+		Logger.Println("Cannot write docker logs to", dockerLog.Path, err)
+	}
+}
+
+// tailDockerLog returns the last lines of the docker log
+func tailDockerLog() string {
+	return getDockerLog().Tail()
+}
+
+// cleanupDockerFiles removes the pid file and the unix socket left behind by
+// a docker daemon which did not exit gracefully
+func cleanupDockerFiles() {
+	if pid, err := ioutil.ReadFile(DockerPidFile); err == nil {
+		if _, err := os.Stat(path.Join("/proc", strings.TrimSpace(string(pid)))); err != nil {
+			Logger.Println("Removing stale docker pid file", DockerPidFile)
+			os.RemoveAll(DockerPidFile)
+		}
+	}
+	// the activated socket belongs to systemd
+	unixsock := strings.TrimPrefix(DockerDefaultHost, "unix://")
+	if len(DockerActivatedSockets) == 0 && utils.FileExist(unixsock) {
+		if conn, err := net.DialTimeout("unix", unixsock, time.Second); err == nil {
+			conn.Close()
+		} else {
+			Logger.Println("Removing stale docker socket", unixsock)
+			os.RemoveAll(unixsock)
 		}
 	}
 }
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newDockerClient returns an http client talking to the local docker daemon
+// through its unix socket
+func newDockerClient(timeout time.Duration) *http.Client {
+	unixsock := strings.TrimPrefix(DockerDefaultHost, "unix://")
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout("unix", unixsock, timeout)
+		},
+		DisableKeepAlives: true,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// dockerAPIGet sends a GET request to the local docker daemon
+func dockerAPIGet(apiPath string, timeout time.Duration) ([]byte, error) {
+	resp, err := newDockerClient(timeout).Get("http://docker" + apiPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", apiPath, resp.Status)
+	}
+	return body, nil
+}
+
+// dockerAPIStream sends a GET request to the local docker daemon, and
+// returns the body as it is streamed
+func dockerAPIStream(apiPath string) (io.ReadCloser, error) {
+	client := newDockerClient(DialTimeOut * time.Second)
+	client.Timeout = 0
+	resp, err := client.Get("http://docker" + apiPath)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", apiPath, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// dockerAPIPost sends a POST request without body to the local docker
+// daemon. 304 Not Modified counts as a success, as docker answers it when
+// the request had nothing to do.
+func dockerAPIPost(apiPath string, timeout time.Duration) ([]byte, error) {
+	resp, err := newDockerClient(timeout).Post("http://docker"+apiPath, "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotModified:
+		return body, nil
+	}
+	return nil, fmt.Errorf("POST %s: %s: %s", apiPath, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// dockerAPIDelete sends a DELETE request to the local docker daemon
+func dockerAPIDelete(apiPath string, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest("DELETE", "http://docker"+apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newDockerClient(timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return body, nil
+	}
+	return nil, fmt.Errorf("DELETE %s: %s: %s", apiPath, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// pingDocker checks that the docker daemon answers /_ping
+func pingDocker(timeout time.Duration) error {
+	body, err := dockerAPIGet("/_ping", timeout)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != "OK" {
+		return errors.New("unexpected /_ping response: " + string(body))
+	}
+	return nil
+}
+
+// WaitDockerReady blocks until the docker daemon accepts connections,
+// whether it is run by the agent or by the init system
+func WaitDockerReady() {
+	if Docker != nil {
+		Docker.WaitReady(0)
+		return
+	}
+	for pingDocker(DialTimeOut*time.Second) != nil {
+		time.Sleep(2 * time.Second)
+	}
+}
@@ -0,0 +1,319 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destinations the docker daemon logs can be forwarded to
+const (
+	LogForwardSyslog   = "syslog"
+	LogForwardJournald = "journald"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// longer lines are split, so that output without newlines cannot grow the
+// buffer forever
+const maxDockerLogLine = 64 * 1024
+
+// DockerLog captures the output of the docker daemon into a file, which is
+// rotated once bigger than MaxSize bytes or older than MaxAge. Rotated files
+// are compressed, and only the Retention most recent ones are kept. The last
+// lines are also kept in memory for crash reports.
+type DockerLog struct {
+	Path      string
+	MaxSize   int64
+	MaxAge    time.Duration
+	Retention int
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	lines   []string
+	next    int
+	partial []byte
+	forward io.Writer
+}
+
+func NewDockerLog(logPath string, maxSize int64, maxAge time.Duration, retention, ringSize int) *DockerLog {
+	return &DockerLog{
+		Path:      logPath,
+		MaxSize:   maxSize,
+		MaxAge:    maxAge,
+		Retention: retention,
+		lines:     make([]string, 0, ringSize),
+	}
+}
+
+// Write appends p to the log file, rotating it beforehand if needed
+func (l *DockerLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.record(p)
+	if l.file != nil && l.needsRotation(int64(len(p))) {
+		if err := l.rotate(); err != nil {
+			Logger.Println("Cannot rotate docker log:", err)
+		}
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *DockerLog) needsRotation(incoming int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.MaxSize > 0 && l.size+incoming > l.MaxSize {
+		return true
+	}
+	return l.MaxAge > 0 && time.Since(l.opened) > l.MaxAge
+}
+
+func (l *DockerLog) open() error {
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	if l.size == 0 {
+		ioutil.WriteFile(l.openedPath(), []byte(strconv.FormatInt(l.opened.Unix(), 10)), 0644)
+	} else if data, err := ioutil.ReadFile(l.openedPath()); err == nil {
+		// the age of the file is kept across agent restarts
+		if opened, err := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64); err == nil {
+			l.opened = time.Unix(opened, 0)
+		}
+	} else {
+		// files written by older agents have no recorded age
+		l.opened = info.ModTime()
+	}
+	return nil
+}
+
+// openedPath is the file recording when the log file was started
+func (l *DockerLog) openedPath() string {
+	return l.Path + ".opened"
+}
+
+// rotate renames the log file to <path>.1.gz, shifting the older ones
+func (l *DockerLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	os.RemoveAll(l.rotatedPath(l.Retention))
+	for i := l.Retention - 1; i >= 1; i-- {
+		if _, err := os.Stat(l.rotatedPath(i)); err == nil {
+			if err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if l.Retention < 1 {
+		return os.Remove(l.Path)
+	}
+	rotated := l.Path + ".1"
+	if err := os.Rename(l.Path, rotated); err != nil {
+		return err
+	}
+	return compressFile(rotated, l.rotatedPath(1))
+}
+
+func (l *DockerLog) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d.gz", l.Path, i)
+}
+
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// record keeps the complete lines of p in the ring buffer and forwards them
+func (l *DockerLog) record(p []byte) {
+	data := append(l.partial, p...)
+	for {
+		var line string
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = string(data[:i])
+			data = data[i+1:]
+		} else if len(data) > maxDockerLogLine {
+			line = string(data[:maxDockerLogLine])
+			data = data[maxDockerLogLine:]
+		} else {
+			break
+		}
+		if cap(l.lines) > 0 {
+			if len(l.lines) < cap(l.lines) {
+				l.lines = append(l.lines, line)
+			} else {
+				l.lines[l.next] = line
+				l.next = (l.next + 1) % cap(l.lines)
+			}
+		}
+		if l.forward != nil {
+			if _, err := l.forward.Write([]byte(line)); err != nil {
+				Logger.Println("Cannot forward docker logs, disabling forwarding:", err)
+				l.forward = nil
+			}
+		}
+	}
+	l.partial = append([]byte{}, data...)
+}
+
+// Tail returns the last lines written, oldest first
+func (l *DockerLog) Tail() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.lines) == 0 {
+		return ""
+	}
+	ordered := append(append([]string{}, l.lines[l.next:]...), l.lines[:l.next]...)
+	return strings.Join(ordered, "\n") + "\n"
+}
+
+// SetForward forwards every line to w, or stops forwarding if w is nil
+func (l *DockerLog) SetForward(w io.Writer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.forward = w
+}
+
+func (l *DockerLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// journaldWriter sends each write as a journal entry, using the native
+// journald protocol
+type journaldWriter struct {
+	conn net.Conn
+}
+
+func newJournaldWriter() (*journaldWriter, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn: conn}, nil
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, '\n') >= 0 {
+		return 0, errors.New("journald messages cannot contain newlines")
+	}
+	entry := fmt.Sprintf("SYSLOG_IDENTIFIER=docker\nPRIORITY=6\nMESSAGE=%s\n", p)
+	if _, err := w.conn.Write([]byte(entry)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newLogForwarder connects to the destination of DockerDaemonLogForward
+func newLogForwarder(destination string) (io.Writer, error) {
+	switch destination {
+	case LogForwardSyslog:
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "docker")
+	case LogForwardJournald:
+		return newJournaldWriter()
+	}
+	return nil, fmt.Errorf("unknown log destination %q", destination)
+}
+
+var (
+	dockerLog      *DockerLog
+	dockerLogMutex sync.Mutex
+)
+
+// getDockerLog returns the log capturing the output of the docker daemon,
+// which lives across daemon restarts
+func getDockerLog() *DockerLog {
+	dockerLogMutex.Lock()
+	defer dockerLogMutex.Unlock()
+
+	logPath := path.Join(LogDir, DockerLogFileName)
+	if dockerLog != nil && dockerLog.Path == logPath {
+		return dockerLog
+	}
+	if dockerLog != nil {
+		dockerLog.Close()
+	}
+
+	maxSize := int64(DockerDaemonLogMaxSize)
+	if Conf.DockerDaemonLogMaxSize > 0 {
+		maxSize = Conf.DockerDaemonLogMaxSize
+	}
+	maxAge := DockerDaemonLogMaxAge
+	if Conf.DockerDaemonLogMaxAge > 0 {
+		maxAge = Conf.DockerDaemonLogMaxAge
+	}
+	retention := DockerDaemonLogRetention
+	if Conf.DockerDaemonLogRetention != nil {
+		retention = *Conf.DockerDaemonLogRetention
+	}
+	dockerLog = NewDockerLog(logPath, maxSize*1024*1024, time.Duration(maxAge)*time.Hour, retention, DockerDaemonLogTailLines)
+
+	if Conf.DockerDaemonLogForward != "" {
+		if w, err := newLogForwarder(Conf.DockerDaemonLogForward); err != nil {
+			SendError(err, "Failed to forward docker logs", nil)
+			Logger.Printf("Cannot forward docker logs to %s: %s", Conf.DockerDaemonLogForward, err)
+		} else {
+			Logger.Println("Forwarding docker logs to", Conf.DockerDaemonLogForward)
+			dockerLog.SetForward(w)
+		}
+	}
+	return dockerLog
+}
@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDockerLogTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerlog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := NewDockerLog(path.Join(dir, "docker.log"), 0, 0, 1, 3)
+	defer l.Close()
+	if l.Tail() != "" {
+		t.Fatal("Expected an empty tail")
+	}
+	l.Write([]byte("line 1\nline 2\n"))
+	l.Write([]byte("line 3\nline "))
+	if tail := l.Tail(); tail != "line 1\nline 2\nline 3\n" {
+		t.Fatalf("Unexpected tail %q", tail)
+	}
+	l.Write([]byte("4\nline 5\n"))
+	if tail := l.Tail(); tail != "line 3\nline 4\nline 5\n" {
+		t.Fatalf("Unexpected tail %q", tail)
+	}
+
+	data, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "line 1\nline 2\nline 3\nline 4\nline 5\n" {
+		t.Fatalf("Unexpected log content %q", data)
+	}
+}
+
+func TestDockerLogRotation(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	dir, err := ioutil.TempDir("", "dockerlog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := NewDockerLog(path.Join(dir, "docker.log"), 20, 0, 2, 10)
+	defer l.Close()
+	for i := 1; i <= 4; i++ {
+		// each write fills a whole file
+		l.Write([]byte(fmt.Sprintf("write %d %010d\n", i, i)))
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if fmt.Sprint(names) != "[docker.log docker.log.1.gz docker.log.2.gz docker.log.opened]" {
+		t.Fatal("Unexpected log files:", names)
+	}
+
+	expected := map[string]string{
+		"docker.log":      "write 4 0000000004\n",
+		"docker.log.1.gz": "write 3 0000000003\n",
+		"docker.log.2.gz": "write 2 0000000002\n",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path.Ext(name) == ".gz" {
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(data) != content {
+			t.Fatalf("%s: expected %q, got %q", name, content, data)
+		}
+	}
+}
+
+func TestDockerLogRotationByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerlog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := NewDockerLog(path.Join(dir, "docker.log"), 0, time.Hour, 0, 10)
+	defer l.Close()
+	l.Write([]byte("old\n"))
+	l.opened = time.Now().Add(-2 * time.Hour)
+	l.Write([]byte("new\n"))
+
+	data, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new\n" {
+		t.Fatalf("Expected the old log to be dropped, got %q", data)
+	}
+	if _, err := os.Stat(l.rotatedPath(1)); err == nil {
+		t.Fatal("Expected no rotated file with a retention of 0")
+	}
+	l.Close()
+
+	// the age of the file is kept when the agent restarts
+	l = NewDockerLog(l.Path, 0, time.Hour, 0, 10)
+	defer l.Close()
+	ioutil.WriteFile(l.Path+".opened", []byte(fmt.Sprint(time.Now().Add(-2*time.Hour).Unix())), 0644)
+	l.Write([]byte("restarted\n"))
+	if data, _ := ioutil.ReadFile(l.Path); string(data) != "new\nrestarted\n" {
+		t.Fatalf("Expected the log to be appended, got %q", data)
+	}
+	l.Write([]byte("rotated\n"))
+	if data, _ := ioutil.ReadFile(l.Path); string(data) != "rotated\n" {
+		t.Fatalf("Expected the log reopened after a restart to be rotated, got %q", data)
+	}
+}
+
+func TestDockerLogForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerlog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var forwarded bytes.Buffer
+	l := NewDockerLog(path.Join(dir, "docker.log"), 0, 0, 1, 10)
+	defer l.Close()
+	l.SetForward(&forwarded)
+	l.Write([]byte("a\nb"))
+	l.Write([]byte("c\n"))
+	if forwarded.String() != "abc" {
+		t.Fatalf("Expected lines to be forwarded without newlines, got %q", forwarded.String())
+	}
+}
@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ValidateDockerConf checks the typed docker settings, so that mistakes are
+// reported when loading the config instead of when the daemon crashes
+func ValidateDockerConf(conf Configuration) error {
+	for _, opt := range conf.DockerStorageOpts {
+		if !strings.Contains(opt, "=") {
+			return fmt.Errorf("DockerStorageOpts: %q is not in key=value format", opt)
+		}
+	}
+	for _, label := range conf.DockerLabels {
+		if !strings.Contains(label, "=") {
+			return fmt.Errorf("DockerLabels: %q is not in key=value format", label)
+		}
+	}
+	for _, dns := range conf.DockerDNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("DockerDNS: %q is not an IP address", dns)
+		}
+	}
+	for _, mirror := range conf.DockerRegistryMirrors {
+		if !strings.HasPrefix(mirror, "http://") && !strings.HasPrefix(mirror, "https://") {
+			return fmt.Errorf("DockerRegistryMirrors: %q must start with http:// or https://", mirror)
+		}
+	}
+	for key := range conf.DockerLogOpts {
+		if key == "" {
+			return fmt.Errorf("DockerLogOpts: empty option name")
+		}
+	}
+	if len(conf.DockerLogOpts) > 0 && conf.DockerLogDriver == "" {
+		return fmt.Errorf("DockerLogOpts: requires DockerLogDriver to be set")
+	}
+	if conf.DockerMemoryLimit < 0 || conf.DockerMemoryReservation < 0 || conf.DockerCPUShares < 0 || conf.DockerCPUQuota < 0 {
+		return fmt.Errorf("DockerMemoryLimit, DockerMemoryReservation, DockerCPUShares and DockerCPUQuota cannot be negative")
+	}
+	if conf.DockerCgroup == "" && (conf.DockerMemoryLimit > 0 || conf.DockerMemoryReservation > 0 || conf.DockerCPUShares > 0 || conf.DockerCPUQuota > 0) {
+		return fmt.Errorf("DockerCgroup must be set to limit docker resources")
+	}
+	if strings.Contains(conf.DockerCgroup, "..") {
+		return fmt.Errorf("DockerCgroup: %q is not a valid cgroup name", conf.DockerCgroup)
+	}
+	if conf.DockerExternalMethod != "" && conf.DockerExternalMethod != ExternalMethodSystemd && conf.DockerExternalMethod != ExternalMethodDaemonJSON {
+		return fmt.Errorf("DockerExternalMethod: %q must be %q or %q", conf.DockerExternalMethod, ExternalMethodSystemd, ExternalMethodDaemonJSON)
+	}
+	if conf.DockerExternal && conf.DockerExternalMethod == ExternalMethodDaemonJSON && conf.DockerOpts != "" {
+		return fmt.Errorf("DockerOpts cannot be applied with DockerExternalMethod %q", ExternalMethodDaemonJSON)
+	}
+	if conf.DockerDaemonLogMaxSize < 0 || conf.DockerDaemonLogMaxAge < 0 || (conf.DockerDaemonLogRetention != nil && *conf.DockerDaemonLogRetention < 0) {
+		return fmt.Errorf("DockerDaemonLogMaxSize, DockerDaemonLogMaxAge and DockerDaemonLogRetention cannot be negative")
+	}
+	if conf.DockerDaemonLogForward != "" && conf.DockerDaemonLogForward != LogForwardSyslog && conf.DockerDaemonLogForward != LogForwardJournald {
+		return fmt.Errorf("DockerDaemonLogForward: %q must be %q or %q", conf.DockerDaemonLogForward, LogForwardSyslog, LogForwardJournald)
+	}
+	switch conf.ContainerLogSink {
+	case "", ContainerLogSinkTutum, ContainerLogSinkSyslog, ContainerLogSinkFile:
+	default:
+		return fmt.Errorf("ContainerLogSink: %q must be %q, %q or %q", conf.ContainerLogSink, ContainerLogSinkTutum, ContainerLogSinkSyslog, ContainerLogSinkFile)
+	}
+	if conf.ContainerLogTailLines < 0 || (conf.ContainerLogRateLimit != nil && *conf.ContainerLogRateLimit < 0) {
+		return fmt.Errorf("ContainerLogTailLines and ContainerLogRateLimit cannot be negative")
+	}
+	if conf.GCHighWatermark < 0 || conf.GCHighWatermark > 100 || conf.GCLowWatermark < 0 || conf.GCLowWatermark > 100 {
+		return fmt.Errorf("GCHighWatermark and GCLowWatermark must be percentages")
+	}
+	high, low := conf.GCHighWatermark, conf.GCLowWatermark
+	if high == 0 {
+		high = GCHighWatermark
+	}
+	if low == 0 {
+		low = GCLowWatermark
+	}
+	if low > high {
+		return fmt.Errorf("GCLowWatermark (%d%%) cannot be above GCHighWatermark (%d%%)", low, high)
+	}
+	if conf.GCContainerMinAge < 0 {
+		return fmt.Errorf("GCContainerMinAge cannot be negative")
+	}
+	if conf.MetricsCollectInterval < 0 {
+		return fmt.Errorf("MetricsCollectInterval cannot be negative")
+	}
+	if conf.MetricsPushInterval < 0 {
+		return fmt.Errorf("MetricsPushInterval cannot be negative")
+	}
+	if conf.DockerUpgradeCheckInterval < 0 {
+		return fmt.Errorf("DockerUpgradeCheckInterval cannot be negative")
+	}
+	if conf.DockerVersion != "" {
+		if _, err := parseDockerVersion(conf.DockerVersion); err != nil {
+			return fmt.Errorf("DockerVersion: %s", err)
+		}
+	}
+	if _, err := GetMaintenancePolicy(conf); err != nil {
+		return err
+	}
+	if conf.DockerBip != "" {
+		if _, _, err := net.ParseCIDR(conf.DockerBip); err != nil {
+			return fmt.Errorf("DockerBip: %q is not in CIDR notation", conf.DockerBip)
+		}
+		if conf.DockerBridge != "" {
+			return fmt.Errorf("DockerBip and DockerBridge are mutually exclusive")
+		}
+	}
+	return nil
+}
+
+// getDockerConfigOpts renders the typed docker settings into daemon flags
+// supported by the given docker version
+func getDockerConfigOpts(conf Configuration, caps DockerCapabilities) []string {
+	var opts []string
+	if conf.DockerStorageDriver != "" {
+		opts = append(opts, "--storage-driver="+conf.DockerStorageDriver)
+	}
+	for _, opt := range conf.DockerStorageOpts {
+		opts = append(opts, "--storage-opt="+opt)
+	}
+	if conf.DockerGraph != "" {
+		if caps.Supports(CapDataRoot) {
+			opts = append(opts, "--data-root="+conf.DockerGraph)
+		} else {
+			opts = append(opts, "--graph="+conf.DockerGraph)
+		}
+	}
+	for _, mirror := range conf.DockerRegistryMirrors {
+		opts = append(opts, "--registry-mirror="+mirror)
+	}
+	for _, registry := range conf.DockerInsecureRegistries {
+		opts = append(opts, "--insecure-registry="+registry)
+	}
+	for _, dns := range conf.DockerDNS {
+		opts = append(opts, "--dns="+dns)
+	}
+	if conf.DockerLogDriver != "" {
+		if caps.Supports(CapLogDriver) {
+			opts = append(opts, "--log-driver="+conf.DockerLogDriver)
+		} else {
+			Logger.Println("Docker", caps.Version, "does not support --log-driver, ignoring DockerLogDriver")
+		}
+	}
+	if len(conf.DockerLogOpts) > 0 {
+		if caps.Supports(CapLogOpts) {
+			keys := make([]string, 0, len(conf.DockerLogOpts))
+			for key := range conf.DockerLogOpts {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				opts = append(opts, fmt.Sprintf("--log-opt=%s=%s", key, conf.DockerLogOpts[key]))
+			}
+		} else {
+			Logger.Println("Docker", caps.Version, "does not support --log-opt, ignoring DockerLogOpts")
+		}
+	}
+	if conf.DockerBridge != "" {
+		opts = append(opts, "--bridge="+conf.DockerBridge)
+	}
+	if conf.DockerBip != "" {
+		opts = append(opts, "--bip="+conf.DockerBip)
+	}
+	for _, label := range conf.DockerLabels {
+		opts = append(opts, "--label="+label)
+	}
+	if conf.DockerLiveRestore {
+		if caps.Supports(CapLiveRestore) {
+			opts = append(opts, "--live-restore")
+		} else {
+			Logger.Println("Docker", caps.Version, "does not support --live-restore, ignoring DockerLiveRestore")
+		}
+	}
+	return opts
+}
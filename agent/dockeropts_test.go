@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestValidateDockerConf(t *testing.T) {
+	valid := Configuration{
+		DockerStorageOpts:     []string{"dm.basesize=20G"},
+		DockerDNS:             []string{"8.8.8.8"},
+		DockerRegistryMirrors: []string{"https://mirror.example.com"},
+		DockerLogDriver:       "json-file",
+		DockerLogOpts:         map[string]string{"max-size": "10m"},
+		DockerBip:             "172.17.42.1/16",
+		DockerLabels:          []string{"region=eu"},
+	}
+	if err := ValidateDockerConf(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []Configuration{
+		{DockerStorageOpts: []string{"dm.basesize"}},
+		{DockerDNS: []string{"dns.example.com"}},
+		{DockerRegistryMirrors: []string{"mirror.example.com"}},
+		{DockerLogOpts: map[string]string{"max-size": "10m"}},
+		{DockerBip: "172.17.42.1"},
+		{DockerBip: "172.17.42.1/16", DockerBridge: "br0"},
+		{DockerLabels: []string{"region"}},
+	}
+	for _, conf := range invalid {
+		if err := ValidateDockerConf(conf); err == nil {
+			t.Errorf("Expected error for %+v", conf)
+		}
+	}
+}
+
+func TestGetDockerConfigOpts(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	conf := Configuration{
+		DockerStorageDriver: "overlay",
+		DockerGraph:         "/data/docker",
+		DockerDNS:           []string{"8.8.8.8", "8.8.4.4"},
+		DockerLogDriver:     "json-file",
+		DockerLogOpts:       map[string]string{"max-size": "10m", "max-file": "3"},
+		DockerLabels:        []string{"region=eu"},
+	}
+
+	v1_9, _ := semver.Make("1.9.1")
+	expected := []string{
+		"--storage-driver=overlay",
+		"--graph=/data/docker",
+		"--dns=8.8.8.8",
+		"--dns=8.8.4.4",
+		"--log-driver=json-file",
+		"--log-opt=max-file=3",
+		"--log-opt=max-size=10m",
+		"--label=region=eu",
+	}
+	if opts := getDockerConfigOpts(conf, GetDockerCapabilities(v1_9)); !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, opts)
+	}
+
+	v1_7_1, _ := semver.Make("1.7.1")
+	expected = []string{
+		"--storage-driver=overlay",
+		"--graph=/data/docker",
+		"--dns=8.8.8.8",
+		"--dns=8.8.4.4",
+		"--log-driver=json-file",
+		"--label=region=eu",
+	}
+	if opts := getDockerConfigOpts(conf, GetDockerCapabilities(v1_7_1)); !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Expected %v, got %v", expected, opts)
+	}
+}
+
+func TestGetDockerConfigOptsLiveRestore(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	conf := Configuration{DockerLiveRestore: true}
+
+	v1_12, _ := semver.Make("1.12.0")
+	if opts := getDockerConfigOpts(conf, GetDockerCapabilities(v1_12)); !reflect.DeepEqual(opts, []string{"--live-restore"}) {
+		t.Fatalf("Expected --live-restore, got %v", opts)
+	}
+	v1_11, _ := semver.Make("1.11.2")
+	if opts := getDockerConfigOpts(conf, GetDockerCapabilities(v1_11)); len(opts) != 0 {
+		t.Fatalf("Expected no options, got %v", opts)
+	}
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// Engine is a container engine run by the agent. The maintenance loop, the
+// health checker and the upgrades only drive the engine through it.
+type Engine interface {
+	// Start launches the engine, and keeps it running until Stop is called
+	Start()
+	// Stop terminates the engine and waits for it to exit
+	Stop()
+	State() DockerState
+	// Pid returns the pid of the engine, or 0 if it is not running
+	Pid() int
+	// WaitReady blocks until the engine accepts connections, or until
+	// timeout expires if it is not zero
+	WaitReady(timeout time.Duration) bool
+	// Health checks that the engine answers its API, and returns the time
+	// the check took
+	Health(timeout time.Duration) (time.Duration, error)
+	// Version returns the version of the installed engine
+	Version() semver.Version
+	// Install replaces the installed engine with the one in file, keeping
+	// the current one for Rollback. The engine must be stopped.
+	Install(file string) error
+	// Rollback restores the engine replaced by the last Install. The engine
+	// must be stopped.
+	Rollback() error
+}
+
+// DockerEngine is the docker daemon installed at BinPath, run by a
+// DockerSupervisor
+type DockerEngine struct {
+	*DockerSupervisor
+	BinPath string
+}
+
+func NewDockerEngine(dockerBinPath, keyFilePath, certFilePath, caFilePath string) *DockerEngine {
+	return &DockerEngine{
+		DockerSupervisor: NewDockerSupervisor(dockerBinPath, keyFilePath, certFilePath, caFilePath),
+		BinPath:          dockerBinPath,
+	}
+}
+
+func (e *DockerEngine) Health(timeout time.Duration) (time.Duration, error) {
+	return checkDockerHealth(timeout)
+}
+
+func (e *DockerEngine) Version() semver.Version {
+	return getDockerVersion(e.BinPath)
+}
+
+func (e *DockerEngine) Install(file string) error {
+	if err := installDockerFile(file, e.BinPath, true); err != nil {
+		return err
+	}
+	createDockerSymlink(e.BinPath, DockerSymbolicLink)
+	return nil
+}
+
+func (e *DockerEngine) Rollback() error {
+	prevBinPath := path.Join(path.Dir(e.BinPath), DockerPrevBinaryName)
+	if !utils.FileExist(prevBinPath) {
+		return errors.New("no previous docker binary found at " + prevBinPath)
+	}
+	if err := swapDockerBinaries(path.Dir(e.BinPath)); err != nil {
+		return err
+	}
+	createDockerSymlink(e.BinPath, DockerSymbolicLink)
+	return nil
+}
+
+// engineLifecycle serializes the operations stopping and starting the
+// engine: upgrades, rollbacks and the restarts of the health checker. Its
+// generation changes whenever one of them begins or ends, which tells a
+// health check that the engine it checked was stopped or replaced meanwhile.
+type engineLifecycle struct {
+	mutex      sync.Mutex
+	generation uint64
+}
+
+var dockerLifecycle engineLifecycle
+
+func (l *engineLifecycle) Lock() {
+	l.mutex.Lock()
+	atomic.AddUint64(&l.generation, 1)
+}
+
+func (l *engineLifecycle) Unlock() {
+	atomic.AddUint64(&l.generation, 1)
+	l.mutex.Unlock()
+}
+
+func (l *engineLifecycle) Generation() uint64 {
+	return atomic.LoadUint64(&l.generation)
+}
+
+// LockSince takes the lock, unless an operation began or ended since
+// generation
+func (l *engineLifecycle) LockSince(generation uint64) bool {
+	l.mutex.Lock()
+	if l.Generation() != generation {
+		l.mutex.Unlock()
+		return false
+	}
+	atomic.AddUint64(&l.generation, 1)
+	return true
+}
+
+// waitEngineHealthy waits until the engine is up and passes its health
+// check, or returns an error once timeout expires
+func waitEngineHealthy(engine Engine, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if !engine.WaitReady(timeout) {
+		return fmt.Errorf("docker daemon is not ready after %s (state: %s)", timeout, engine.State())
+	}
+	for {
+		_, err := engine.Health(DialTimeOut * time.Second)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("docker daemon is not healthy after %s: %s", timeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
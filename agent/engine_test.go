@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+	"golang.org/x/crypto/openpgp"
+)
+
+type engineTest struct {
+	dir         string
+	signer      *openpgp.Entity
+	newBinPath  string
+	sigPath     string
+	upgradeNow  string
+	rollbackReq string
+}
+
+// setupEngineTest trusts a test key, and points docker at a missing socket
+// so that container snapshots are empty
+func setupEngineTest(t *testing.T) (*engineTest, func()) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "engine-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := &engineTest{
+		dir:         dir,
+		signer:      newTestEntity(t, "signer"),
+		newBinPath:  path.Join(dir, DockerNewBinaryName),
+		sigPath:     path.Join(dir, DockerNewBinarySigName),
+		upgradeNow:  path.Join(dir, DockerUpgradeNowName),
+		rollbackReq: path.Join(dir, DockerRollbackName),
+	}
+	var keyring bytes.Buffer
+	if err := test.signer.Serialize(&keyring); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "keyring.gpg"), keyring.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConf, oldHost, oldTimeout := Conf, DockerDefaultHost, upgradeHealthTimeout
+	Conf = Configuration{ExtraKeyring: path.Join(dir, "keyring.gpg")}
+	DockerDefaultHost = "unix://" + path.Join(dir, "docker.sock")
+	upgradeHealthTimeout = 2 * time.Second
+	return test, func() {
+		Conf, DockerDefaultHost, upgradeHealthTimeout = oldConf, oldHost, oldTimeout
+		os.RemoveAll(dir)
+	}
+}
+
+// stage drops a signed build of version as the fake engine installs it
+func (test *engineTest) stage(t *testing.T, version string) {
+	if err := ioutil.WriteFile(test.newBinPath, []byte(version), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, test.signer, bytes.NewReader([]byte(version)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(test.sigPath, sig.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startFakeEngine(t *testing.T, version string) *fakeEngine {
+	engine := newFakeEngine(version)
+	engine.Start()
+	if !engine.WaitReady(time.Second) {
+		t.Fatal("Expected the fake engine to start")
+	}
+	return engine
+}
+
+func TestUpdateDockerAppliesHealthyUpgrade(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	engine.StartDelay = 300 * time.Millisecond
+	test.stage(t, "1.10.3")
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+
+	if v := engine.Version().String(); v != "1.10.3" {
+		t.Fatal("Expected docker 1.10.3, got", v)
+	}
+	if engine.State() != DockerRunning || engine.stops != 1 || engine.starts != 2 {
+		t.Fatalf("Expected docker to be restarted once, state %s, %d stops, %d starts", engine.State(), engine.stops, engine.starts)
+	}
+	if utils.FileExist(test.newBinPath) || utils.FileExist(test.sigPath) {
+		t.Fatal("Expected the staged files to be consumed")
+	}
+}
+
+func TestUpdateDockerRestartsCurrentEngineWhenInstallFails(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	// the fake engine cannot install a build without version
+	test.stage(t, "not a docker build")
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+
+	if v := engine.Version().String(); v != "1.9.1" || engine.installs != 0 {
+		t.Fatal("Expected docker 1.9.1 to be kept, got", v)
+	}
+	if engine.State() != DockerRunning || engine.starts != 2 {
+		t.Fatalf("Expected the current docker to be started again, state %s, %d starts", engine.State(), engine.starts)
+	}
+	if utils.FileExist(test.newBinPath) || utils.FileExist(test.sigPath) {
+		t.Fatal("Expected the staged files to be removed")
+	}
+}
+
+func TestUpdateDockerRollsBackCrashingUpgrade(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	engine.broken["1.10.3"] = true
+	test.stage(t, "1.10.3")
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+
+	if v := engine.Version().String(); v != "1.9.1" {
+		t.Fatal("Expected docker to be rolled back to 1.9.1, got", v)
+	}
+	if engine.State() != DockerRunning {
+		t.Fatal("Expected the previous docker to be running, got", engine.State())
+	}
+}
+
+func TestUpdateDockerRollsBackSlowUpgrade(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	engine.StartDelay = 3 * time.Second
+	test.stage(t, "1.10.3")
+	go func() {
+		// the previous docker starts in time again
+		time.Sleep(time.Second)
+		engine.mutex.Lock()
+		engine.StartDelay = 0
+		engine.mutex.Unlock()
+	}()
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+
+	if v := engine.Version().String(); v != "1.9.1" {
+		t.Fatal("Expected docker to be rolled back to 1.9.1, got", v)
+	}
+}
+
+func TestUpdateDockerRejectsUnsignedUpgrade(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	test.stage(t, "1.10.3")
+	if err := ioutil.WriteFile(test.newBinPath, []byte("1.11.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+
+	if engine.installs != 0 || engine.stops != 0 {
+		t.Fatal("Expected a build with an invalid signature not to be installed")
+	}
+	if utils.FileExist(test.newBinPath) || utils.FileExist(test.sigPath) {
+		t.Fatal("Expected the invalid build to be removed")
+	}
+}
+
+func TestUpdateDockerHoldsUpgradeOutsideMaintenanceWindows(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	now := time.Now().UTC()
+	closed := (now.Weekday() + 3) % 7
+	Conf.DockerMaintenanceWindows = []string{closed.String()[:3] + " 00:00-24:00"}
+	Conf.DockerMaintenanceTimezone = "UTC"
+
+	engine := startFakeEngine(t, "1.9.1")
+	test.stage(t, "1.10.3")
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+	if engine.installs != 0 || !utils.FileExist(test.newBinPath) {
+		t.Fatal("Expected the upgrade to be held")
+	}
+
+	if err := ioutil.WriteFile(test.upgradeNow, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+	if v := engine.Version().String(); v != "1.10.3" {
+		t.Fatal("Expected upgrade-now to apply the upgrade, got", v)
+	}
+}
+
+func TestRollbackDockerIfRequested(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	RollbackDockerIfRequested(engine, test.rollbackReq)
+	if engine.stops != 0 {
+		t.Fatal("Expected no rollback without request")
+	}
+
+	test.stage(t, "1.10.3")
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+	if err := ioutil.WriteFile(test.rollbackReq, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	RollbackDockerIfRequested(engine, test.rollbackReq)
+	if v := engine.Version().String(); v != "1.9.1" || engine.State() != DockerRunning {
+		t.Fatalf("Expected docker 1.9.1 to be running, got %s (%s)", v, engine.State())
+	}
+	if utils.FileExist(test.rollbackReq) {
+		t.Fatal("Expected the rollback request to be consumed")
+	}
+}
+
+func TestHealthCheckerRestartsHungEngine(t *testing.T) {
+	_, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	h := NewDockerHealthChecker(engine)
+	h.Timeout = 10 * time.Millisecond
+	h.Retries = 2
+
+	h.CheckOnce()
+	engine.Hang()
+	h.CheckOnce()
+	if engine.stops != 0 {
+		t.Fatal("Expected no restart after a single failure")
+	}
+	h.CheckOnce()
+	if engine.stops != 1 || engine.State() != DockerRunning {
+		t.Fatalf("Expected the hung engine to be restarted, %d stops, state %s", engine.stops, engine.State())
+	}
+	h.CheckOnce()
+	if health := h.Health(); health.Error != "" || health.Failures != 0 {
+		t.Fatal("Expected the restarted engine to be healthy:", health)
+	}
+}
+
+func TestHealthCheckerSkipsCrashedEngine(t *testing.T) {
+	_, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	engine.StartDelay = time.Second
+	h := NewDockerHealthChecker(engine)
+	h.Retries = 1
+
+	engine.Crash()
+	h.CheckOnce()
+	if engine.stops != 0 {
+		t.Fatal("Expected the respawning engine not to be restarted by the health checker")
+	}
+	if !engine.WaitReady(2 * time.Second) {
+		t.Fatal("Expected the crashed engine to be respawned")
+	}
+}
+
+func TestHealthCheckerDuringUpgrade(t *testing.T) {
+	test, cleanup := setupEngineTest(t)
+	defer cleanup()
+
+	engine := startFakeEngine(t, "1.9.1")
+	h := NewDockerHealthChecker(engine)
+	h.Timeout = 300 * time.Millisecond
+	h.Retries = 1
+	test.stage(t, "1.10.3")
+
+	// the check of the hung engine is in flight when the upgrade starts
+	engine.Hang()
+	checked := make(chan struct{})
+	go func() {
+		h.CheckOnce()
+		close(checked)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	UpdateDocker(engine, test.newBinPath, test.sigPath, test.upgradeNow)
+	<-checked
+
+	if v := engine.Version().String(); v != "1.10.3" {
+		t.Fatal("Expected docker 1.10.3, got", v)
+	}
+	if engine.State() != DockerRunning || engine.stops != 1 || engine.starts != 2 {
+		t.Fatalf("Expected a single restart by the upgrade, state %s, %d stops, %d starts", engine.State(), engine.stops, engine.starts)
+	}
+	if health := h.Health(); health.Failures != 0 {
+		t.Fatal("Expected the failed check of the replaced engine to be ignored:", health)
+	}
+}
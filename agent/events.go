@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// docker event types forwarded to Tutum. Events of docker before 1.10 have
+// no type and are all about containers and images.
+var forwardedEventTypes = map[string]bool{
+	"":          true,
+	"container": true,
+	"image":     true,
+	"network":   true,
+}
+
+// EventBuffer is a disk-backed queue of docker events, one JSON object per
+// line, which survives agent restarts. It also records the time of the last
+// event received, to resume the docker event stream from there. Events are
+// numbered in memory from head, the number of the oldest event, so that
+// events dropped while a batch is sent are not acknowledged twice.
+type EventBuffer struct {
+	Max int
+
+	path   string
+	mutex  sync.Mutex
+	events []json.RawMessage
+	head   uint64
+	since  int64
+	file   *os.File
+}
+
+// OpenEventBuffer loads the events left in the buffer at path
+func OpenEventBuffer(path string, max int) (*EventBuffer, error) {
+	b := &EventBuffer{Max: max, path: path}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var event json.RawMessage
+			if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+				b.events = append(b.events, event)
+			}
+		}
+	}
+	if data, err := ioutil.ReadFile(path + ".since"); err == nil {
+		b.since, _ = strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	}
+	if err := b.rewrite(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Since returns the time, in seconds, of the last event appended
+func (b *EventBuffer) Since() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.since
+}
+
+func (b *EventBuffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.events)
+}
+
+// Append adds an event which happened at time since, dropping the oldest
+// events once the buffer holds more than Max. A tenth of the buffer is
+// dropped at once, so that the file is not rewritten for every new event.
+// The time is only recorded once the event is written.
+func (b *EventBuffer) Append(event json.RawMessage, since int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.events = append(b.events, event)
+	if b.Max > 0 && len(b.events) > b.Max {
+		dropped := len(b.events) - b.Max + b.Max/10
+		b.events = b.events[dropped:]
+		b.head += uint64(dropped)
+		Logger.Printf("Docker event buffer is full, dropped %d events", dropped)
+		if err := b.rewrite(); err != nil {
+			return err
+		}
+	} else if _, err := b.file.Write(append(append([]byte{}, event...), '\n')); err != nil {
+		return err
+	}
+	if since > b.since {
+		b.since = since
+		ioutil.WriteFile(b.path+".since", []byte(strconv.FormatInt(since, 10)), 0644)
+	}
+	return nil
+}
+
+// Peek returns up to n events, oldest first, without removing them, and
+// the number of the first one
+func (b *EventBuffer) Peek(n int) (uint64, []json.RawMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if n > len(b.events) {
+		n = len(b.events)
+	}
+	return b.head, append([]json.RawMessage{}, b.events[:n]...)
+}
+
+// Ack removes the n events from number first, once delivered. The events
+// which were dropped since they were peeked are not counted twice.
+func (b *EventBuffer) Ack(first uint64, n int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	end := first + uint64(n)
+	if end <= b.head {
+		return nil
+	}
+	acked := end - b.head
+	if acked > uint64(len(b.events)) {
+		acked = uint64(len(b.events))
+	}
+	b.events = b.events[acked:]
+	b.head += acked
+	return b.rewrite()
+}
+
+func (b *EventBuffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// rewrite replaces the buffer file with the events in memory, and reopens
+// it for appending. It must be called with the mutex held.
+func (b *EventBuffer) rewrite() error {
+	var buf bytes.Buffer
+	for _, event := range b.events {
+		buf.Write(event)
+		buf.WriteByte('\n')
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	if b.file != nil {
+		b.file.Close()
+	}
+	file, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		b.file = nil
+		return err
+	}
+	b.file = file
+	return nil
+}
+
+// EventForwarder follows the docker event stream, buffers the events on
+// disk, and sends them to Tutum in batches. Events are only removed from the
+// buffer once Tutum accepted them, so they may be sent more than once.
+type EventForwarder struct {
+	BatchSize     int
+	FlushInterval time.Duration
+
+	buffer *EventBuffer
+	stream func(since int64) (io.ReadCloser, error)
+	send   func(events []json.RawMessage) error
+}
+
+func NewEventForwarder(bufferPath string) (*EventForwarder, error) {
+	buffer, err := OpenEventBuffer(bufferPath, EventsBufferMax)
+	if err != nil {
+		return nil, err
+	}
+	return &EventForwarder{
+		BatchSize:     EventsBatchSize,
+		FlushInterval: EventsFlushInterval * time.Second,
+		buffer:        buffer,
+		stream:        streamDockerEvents,
+		send:          sendEventsToTutum,
+	}, nil
+}
+
+// ForwardDockerEvents forwards the docker events to Tutum, forever
+func ForwardDockerEvents(bufferPath string) {
+	f, err := NewEventForwarder(bufferPath)
+	if err != nil {
+		SendError(err, "Failed to open the docker event buffer", nil)
+		Logger.Println("Cannot forward docker events:", err)
+		return
+	}
+	go f.Receive()
+	f.Forward()
+}
+
+// Receive buffers the events of the docker event stream, forever. The
+// stream is resumed from the last event received when docker restarts.
+func (f *EventForwarder) Receive() {
+	for {
+		WaitDockerReady()
+		if err := f.receiveOnce(); err != nil {
+			Logger.Println("Docker event stream interrupted:", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (f *EventForwarder) receiveOnce() error {
+	since := f.buffer.Since()
+	if since == 0 {
+		since = time.Now().Unix()
+	}
+	body, err := f.stream(since)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return errors.New("docker closed the event stream")
+			}
+			return err
+		}
+		var event struct {
+			Type string
+			Time int64 `json:"time"`
+		}
+		if err := json.Unmarshal(raw, &event); err != nil {
+			continue
+		}
+		if !forwardedEventTypes[event.Type] {
+			continue
+		}
+		if err := f.buffer.Append(raw, event.Time); err != nil {
+			SendError(err, "Failed to buffer docker event", nil)
+			Logger.Println("Cannot buffer docker event:", err)
+		}
+	}
+}
+
+// Forward sends the buffered events every FlushInterval, forever, backing
+// off while Tutum does not accept them
+func (f *EventForwarder) Forward() {
+	backoff := f.FlushInterval
+	for {
+		time.Sleep(backoff)
+		if err := f.Flush(); err != nil {
+			Logger.Printf("Cannot send docker events to Tutum (%d buffered): %s", f.buffer.Len(), err)
+			if backoff *= 2; backoff > MaxWaitingTime*time.Second {
+				backoff = MaxWaitingTime * time.Second
+			}
+			continue
+		}
+		backoff = f.FlushInterval
+	}
+}
+
+// Flush sends all the buffered events, in batches of BatchSize
+func (f *EventForwarder) Flush() error {
+	for {
+		first, events := f.buffer.Peek(f.BatchSize)
+		if len(events) == 0 {
+			return nil
+		}
+		if err := f.send(events); err != nil {
+			return err
+		}
+		if err := f.buffer.Ack(first, len(events)); err != nil {
+			return err
+		}
+	}
+}
+
+func streamDockerEvents(since int64) (io.ReadCloser, error) {
+	return dockerAPIStream(fmt.Sprintf("/events?since=%d", since))
+}
+
+func sendEventsToTutum(events []json.RawMessage) error {
+	return postNode(EventsEndpoint, events)
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEventBuffer(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, EventsBufferName)
+	b, err := OpenEventBuffer(file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if err := b.Append(json.RawMessage(fmt.Sprintf(`{"id":"%d"}`, i)), int64(100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first, _ := b.Peek(1); b.Ack(first, 1) != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// reopened after a restart, without the dropped and acked events
+	b, err = OpenEventBuffer(file, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, events := b.Peek(10)
+	if len(events) != 2 || string(events[0]) != `{"id":"3"}` || string(events[1]) != `{"id":"4"}` {
+		t.Fatalf("Unexpected buffered events %s", events)
+	}
+	if b.Since() != 104 {
+		t.Fatal("Expected the stream to resume from 104, got", b.Since())
+	}
+}
+
+func TestEventBufferDropsInChunks(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, EventsBufferName)
+	b, err := OpenEventBuffer(file, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 21; i++ {
+		if err := b.Append(json.RawMessage(fmt.Sprintf(`{"id":"%d"}`, i)), int64(100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, events := b.Peek(1); b.Len() != 18 || string(events[0]) != `{"id":"4"}` {
+		t.Fatalf("Expected the 3 oldest events to be dropped, got %d events from %s", b.Len(), events)
+	}
+
+	// the next events are appended without rewriting the file
+	before, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 22; i <= 23; i++ {
+		if err := b.Append(json.RawMessage(fmt.Sprintf(`{"id":"%d"}`, i)), int64(100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || b.Len() != 20 {
+		t.Fatalf("Expected the events to be appended, got %d events", b.Len())
+	}
+
+	// the time of an event which cannot be written is not recorded
+	if first, _ := b.Peek(1); b.Ack(first, 1) != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if err := b.Append(json.RawMessage(`{"id":"24"}`), 124); err == nil {
+		t.Fatal("Expected the append to fail")
+	}
+	if data, _ := ioutil.ReadFile(file + ".since"); string(data) != "123" {
+		t.Fatalf("Expected the stream to resume from 123, got %s", data)
+	}
+}
+
+func TestEventBufferDropsWhileSending(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := OpenEventBuffer(path.Join(dir, EventsBufferName), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := 1; i <= 10; i++ {
+		if err := b.Append(json.RawMessage(fmt.Sprintf(`{"id":"%d"}`, i)), int64(100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, sent := b.Peek(4)
+
+	// the buffer overflows while the batch is sent: events 1 and 2 are
+	// dropped, only events 3 and 4 of the batch are left to acknowledge
+	if err := b.Append(json.RawMessage(`{"id":"11"}`), 111); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Ack(first, len(sent)); err != nil {
+		t.Fatal(err)
+	}
+	if _, events := b.Peek(1); b.Len() != 7 || string(events[0]) != `{"id":"5"}` {
+		t.Fatalf("Expected the unsent events to be kept, got %d events from %s", b.Len(), events)
+	}
+
+	// a batch dropped entirely while it was sent acknowledges nothing
+	first, sent = b.Peek(1)
+	for i := 12; i <= 15; i++ {
+		if err := b.Append(json.RawMessage(fmt.Sprintf(`{"id":"%d"}`, i)), int64(100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Ack(first, len(sent)); err != nil {
+		t.Fatal(err)
+	}
+	if _, events := b.Peek(1); b.Len() != 9 || string(events[0]) != `{"id":"7"}` {
+		t.Fatalf("Expected the unsent events to be kept, got %d events from %s", b.Len(), events)
+	}
+}
+
+func TestEventForwarder(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "events-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var requested []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("since"))
+		fmt.Fprint(w, `{"Type":"container","status":"start","id":"aaa","time":1000}`+"\n")
+		fmt.Fprint(w, `{"Type":"volume","Action":"mount","time":1001}`+"\n")
+		fmt.Fprint(w, `{"status":"die","id":"aaa","from":"busybox","time":1002}`+"\n")
+		fmt.Fprint(w, `{"Type":"network","Action":"connect","time":1003}`+"\n")
+	})
+	defer serveFakeDocker(t, mux)()
+
+	f, err := NewEventForwarder(path.Join(dir, EventsBufferName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.BatchSize = 2
+	var sent [][]json.RawMessage
+	f.send = func(events []json.RawMessage) error {
+		if len(sent) == 1 {
+			sent = append(sent, nil)
+			return errors.New("503")
+		}
+		sent = append(sent, events)
+		return nil
+	}
+
+	if err := f.receiveOnce(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatal("Expected the end of the stream to be reported, got", err)
+	}
+	if f.buffer.Len() != 3 {
+		t.Fatal("Expected the volume event to be filtered out, buffered", f.buffer.Len())
+	}
+	// resumed from the last event after a docker restart
+	f.receiveOnce()
+	if len(requested) != 2 || requested[1] != "1003" {
+		t.Fatal("Expected the stream to resume from the last event, got", requested)
+	}
+	if f.buffer.Len() != 6 {
+		t.Fatal("Expected the events to be buffered again (at least once), buffered", f.buffer.Len())
+	}
+
+	if err := f.Flush(); err == nil {
+		t.Fatal("Expected the failed batch to be reported")
+	}
+	if f.buffer.Len() != 4 {
+		t.Fatal("Expected the failed batch to stay buffered, buffered", f.buffer.Len())
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if f.buffer.Len() != 0 || len(sent) != 4 {
+		t.Fatalf("Expected all the events to be sent, %d buffered, %d batches", f.buffer.Len(), len(sent))
+	}
+}
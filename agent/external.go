@@ -0,0 +1,245 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// Ways of configuring an external docker engine
+const (
+	ExternalMethodSystemd    = "systemd"
+	ExternalMethodDaemonJSON = "daemon.json"
+)
+
+// ConfigureExternalDocker configures the docker engine managed by the init
+// system to listen on DockerHost with the agent TLS certificates, and
+// restarts it when its configuration changed
+func ConfigureExternalDocker(keyFilePath, certFilePath, caFilePath string) error {
+	method, err := externalDockerMethod(Conf, isSystemd())
+	if err != nil {
+		return err
+	}
+
+	var changed bool
+	caps := getExternalDockerCapabilities()
+	switch method {
+	case ExternalMethodSystemd:
+		changed, err = writeExternalDockerDropIn(DockerSystemdDropIn, caps, keyFilePath, certFilePath, caFilePath)
+	case ExternalMethodDaemonJSON:
+		changed, err = writeExternalDockerDaemonConfig(externalDaemonConfigFile(), caps, keyFilePath, certFilePath, caFilePath)
+	}
+	if err != nil {
+		return err
+	}
+	if !changed {
+		Logger.Println("External docker configuration is up to date")
+		return nil
+	}
+	Logger.Printf("External docker configuration updated (%s), restarting docker", method)
+	return restartExternalDocker()
+}
+
+// externalDockerMethod returns how the external docker engine is configured.
+// On systemd hosts this must be done with a drop-in overriding ExecStart, as
+// the -H fd:// flag of the stock docker.service conflicts with hosts set in
+// daemon.json, and docker refuses to start. DockerOpts cannot be written to
+// daemon.json either.
+func externalDockerMethod(conf Configuration, systemd bool) (string, error) {
+	method := conf.DockerExternalMethod
+	if method == "" {
+		method = ExternalMethodDaemonJSON
+		if systemd {
+			method = ExternalMethodSystemd
+		}
+	}
+	switch method {
+	case ExternalMethodSystemd:
+		if !systemd {
+			return "", fmt.Errorf("DockerExternalMethod %q requires systemd", method)
+		}
+	case ExternalMethodDaemonJSON:
+		if systemd {
+			return "", fmt.Errorf("DockerExternalMethod %q cannot be used on systemd hosts, as docker.service passes -H fd://, use %q", method, ExternalMethodSystemd)
+		}
+		if conf.DockerOpts != "" {
+			return "", fmt.Errorf("DockerOpts cannot be applied with DockerExternalMethod %q", method)
+		}
+	default:
+		return "", fmt.Errorf("unknown DockerExternalMethod %q", method)
+	}
+	return method, nil
+}
+
+func isSystemd() bool {
+	return utils.FileExist("/run/systemd/system")
+}
+
+func externalDaemonConfigFile() string {
+	if Conf.DockerDaemonConfigBase != "" {
+		return Conf.DockerDaemonConfigBase
+	}
+	return defaultDockerDaemonConfigBase
+}
+
+// externalDockerBinPath returns the docker installed in PATH
+func externalDockerBinPath() string {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return "/usr/bin/docker"
+	}
+	return docker
+}
+
+func getExternalDockerCapabilities() DockerCapabilities {
+	return GetDockerCapabilities(getDockerVersion(externalDockerBinPath()))
+}
+
+// getExternalDockerCommand returns the command starting the external docker
+// daemon with the agent settings
+func getExternalDockerCommand(caps DockerCapabilities, keyFilePath, certFilePath, caFilePath string) []string {
+	bin, cmd := caps.DaemonCommand(externalDockerBinPath())
+	cmd = append([]string{bin}, cmd...)
+	cmd = append(cmd, "-H", DockerDefaultHost, "-H", Conf.DockerHost)
+	cmd = append(cmd, getDockerTLSOpt(keyFilePath, certFilePath, caFilePath)...)
+	cmd = append(cmd, getDockerConfigOpts(Conf, caps)...)
+	return append(cmd, getDockerExtraOpts(Conf)...)
+}
+
+// renderExternalDockerDropIn returns the drop-in overriding the ExecStart of
+// docker.service with cmd
+func renderExternalDockerDropIn(cmd []string) []byte {
+	args := make([]string, len(cmd))
+	for i, arg := range cmd {
+		args[i] = systemdQuote(arg)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by tutum-agent, do not edit\n")
+	buf.WriteString("[Service]\n")
+	buf.WriteString("ExecStart=\n")
+	fmt.Fprintf(&buf, "ExecStart=%s\n", strings.Join(args, " "))
+	return buf.Bytes()
+}
+
+// systemdQuote quotes an argument of a command line of a unit file, as
+// described in systemd.syntax(7) and systemd.service(5). Specifiers (%) and
+// environment variables ($) are escaped so that they are passed as is.
+func systemdQuote(arg string) string {
+	var buf bytes.Buffer
+	quote := arg == ""
+	for _, r := range arg {
+		switch r {
+		case '\\', '"':
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+		case '%':
+			buf.WriteString("%%")
+		case '$':
+			buf.WriteString("$$")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\t':
+			buf.WriteString("\\t")
+		case ' ', '\'', ';':
+			quote = true
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	if quote {
+		return `"` + buf.String() + `"`
+	}
+	return buf.String()
+}
+
+// writeExternalDockerDropIn writes the systemd drop-in of docker.service,
+// and reports whether it changed
+func writeExternalDockerDropIn(dropInFile string, caps DockerCapabilities, keyFilePath, certFilePath, caFilePath string) (bool, error) {
+	cmd := getExternalDockerCommand(caps, keyFilePath, certFilePath, caFilePath)
+
+	base, err := loadDaemonConfigBase(externalDaemonConfigFile())
+	if err != nil {
+		Logger.Println("Cannot check docker daemon.json for conflicts:", err)
+	} else {
+		for _, conflict := range findDaemonConfigConflicts(base, cmd[1:]) {
+			Logger.Println("WARNING: docker daemon.json conflicts with the agent settings, docker may refuse to start:", conflict)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(dropInFile), 0755); err != nil {
+		return false, err
+	}
+	changed, err := writeFileIfChanged(dropInFile, renderExternalDockerDropIn(cmd), 0644)
+	if err != nil || !changed {
+		return changed, err
+	}
+	if out, err := exec.Command("systemctl", "daemon-reload").CombinedOutput(); err != nil {
+		return true, fmt.Errorf("systemctl daemon-reload: %s: %s", err, out)
+	}
+	return true, nil
+}
+
+// writeExternalDockerDaemonConfig merges the agent settings into the
+// daemon.json of the host, and reports whether it changed
+func writeExternalDockerDaemonConfig(configFile string, caps DockerCapabilities, keyFilePath, certFilePath, caFilePath string) (bool, error) {
+	config, err := loadDaemonConfigBase(configFile)
+	if err != nil {
+		return false, err
+	}
+	agent := getDockerDaemonConfig(Conf, caps)
+	agent["hosts"] = []string{DockerDefaultHost, Conf.DockerHost}
+	agent["tlscert"] = certFilePath
+	agent["tlskey"] = keyFilePath
+	if *FlagStandalone && !utils.FileExist(caFilePath) {
+		agent["tls"] = true
+	} else {
+		agent["tlscacert"] = caFilePath
+		agent["tlsverify"] = true
+	}
+	merged, overridden := mergeDaemonConfig(config, agent)
+	for _, key := range overridden {
+		Logger.Printf("Docker setting '%s' in %s is overridden by the agent configuration", key, configFile)
+	}
+
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(path.Dir(configFile), 0755); err != nil {
+		return false, err
+	}
+	return writeFileIfChanged(configFile, data, 0644)
+}
+
+func writeFileIfChanged(file string, data []byte, perm os.FileMode) (bool, error) {
+	if current, err := ioutil.ReadFile(file); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(file, data, perm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// restartExternalDocker restarts docker through the init system
+func restartExternalDocker() error {
+	var cmd *exec.Cmd
+	if isSystemd() {
+		cmd = exec.Command("systemctl", "restart", "docker")
+	} else {
+		cmd = exec.Command("service", "docker", "restart")
+	}
+	Logger.Println("Restarting docker:", cmd.Args)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s: %s", strings.Join(cmd.Args, " "), err, out)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestExternalDockerMethod(t *testing.T) {
+	for _, test := range []struct {
+		conf    Configuration
+		systemd bool
+		method  string
+	}{
+		{Configuration{}, true, ExternalMethodSystemd},
+		{Configuration{}, false, ExternalMethodDaemonJSON},
+		{Configuration{DockerExternalMethod: ExternalMethodSystemd}, true, ExternalMethodSystemd},
+		{Configuration{DockerExternalMethod: ExternalMethodSystemd}, false, ""},
+		{Configuration{DockerExternalMethod: ExternalMethodDaemonJSON}, true, ""},
+		{Configuration{DockerOpts: "--ip-forward=false"}, true, ExternalMethodSystemd},
+		{Configuration{DockerOpts: "--ip-forward=false"}, false, ""},
+		{Configuration{DockerExternalMethod: "upstart"}, false, ""},
+	} {
+		method, err := externalDockerMethod(test.conf, test.systemd)
+		if method != test.method || (test.method == "") != (err != nil) {
+			t.Errorf("%+v (systemd: %v): expected %q, got %q (%v)", test.conf, test.systemd, test.method, method, err)
+		}
+	}
+}
+
+func TestSystemdQuote(t *testing.T) {
+	for arg, expected := range map[string]string{
+		"--tlsverify":             "--tlsverify",
+		"":                        `""`,
+		"/data/my docker":         `"/data/my docker"`,
+		"--label=name=50%":        "--label=name=50%%",
+		`--label=a"b\c`:           `--label=a\"b\\c`,
+		"--label=$HOME":           "--label=$$HOME",
+		";":                       `";"`,
+		"--log-opt=tag={{.Name}}": "--log-opt=tag={{.Name}}",
+	} {
+		if quoted := systemdQuote(arg); quoted != expected {
+			t.Errorf("%q: expected %s, got %s", arg, expected, quoted)
+		}
+	}
+}
+
+func TestExternalDockerDropIn(t *testing.T) {
+	standalone := false
+	oldStandalone, oldConf := FlagStandalone, Conf
+	FlagStandalone = &standalone
+	defer func() { FlagStandalone, Conf = oldStandalone, oldConf }()
+	Conf = Configuration{DockerHost: "tcp://0.0.0.0:2375", DockerLabels: []string{"name=my node"}, DockerOpts: `--ip-forward=false --label "rack=50%"`}
+
+	v, _ := semver.Make("1.12.0")
+	cmd := getExternalDockerCommand(GetDockerCapabilities(v), "/tutum/key.pem", "/tutum/cert.pem", "/tutum/ca.pem")
+	if cmd[len(cmd)-3] != "--ip-forward=false" || cmd[len(cmd)-1] != "rack=50%" {
+		t.Errorf("expected DockerOpts to be appended last, got %v", cmd)
+	}
+	dropIn := string(renderExternalDockerDropIn(cmd))
+	lines := strings.Split(dropIn, "\n")
+	if len(lines) != 5 || lines[1] != "[Service]" || lines[2] != "ExecStart=" {
+		t.Fatalf("unexpected drop-in:\n%s", dropIn)
+	}
+	for _, expected := range []string{"ExecStart=", " -H tcp://0.0.0.0:2375 ", " --tlscacert /tutum/ca.pem ", ` "--label=name=my node" `, " rack=50%%"} {
+		if !strings.Contains(lines[3], expected) {
+			t.Errorf("expected %q in %s", expected, lines[3])
+		}
+	}
+}
+
+func TestExternalDockerDaemonConfig(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	standalone := false
+	oldStandalone, oldConf := FlagStandalone, Conf
+	FlagStandalone = &standalone
+	defer func() { FlagStandalone, Conf = oldStandalone, oldConf }()
+	Conf = Configuration{DockerHost: "tcp://0.0.0.0:2375", DockerStorageDriver: "overlay"}
+
+	dir, err := ioutil.TempDir("", "external-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, "daemon.json")
+	ioutil.WriteFile(configFile, []byte(`{"storage-driver":"devicemapper","dns":["8.8.8.8"]}`), 0644)
+
+	v, _ := semver.Make("1.12.0")
+	caps := GetDockerCapabilities(v)
+	changed, err := writeExternalDockerDaemonConfig(configFile, caps, "/tutum/key.pem", "/tutum/cert.pem", "/tutum/ca.pem")
+	if err != nil || !changed {
+		t.Fatalf("expected daemon.json to be written, got %v, %v", changed, err)
+	}
+	data, _ := ioutil.ReadFile(configFile)
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["storage-driver"] != "overlay" || config["tlscacert"] != "/tutum/ca.pem" || config["tlsverify"] != true {
+		t.Errorf("expected the agent settings to be merged, got %s", data)
+	}
+	if dns, ok := config["dns"].([]interface{}); !ok || len(dns) != 1 {
+		t.Errorf("expected the other settings to be kept, got %s", data)
+	}
+	if hosts, ok := config["hosts"].([]interface{}); !ok || len(hosts) != 2 || hosts[1] != "tcp://0.0.0.0:2375" {
+		t.Errorf("unexpected hosts in %s", data)
+	}
+
+	// docker is not restarted when nothing changed
+	changed, err = writeExternalDockerDaemonConfig(configFile, caps, "/tutum/key.pem", "/tutum/cert.pem", "/tutum/ca.pem")
+	if err != nil || changed {
+		t.Errorf("expected daemon.json to be unchanged, got %v, %v", changed, err)
+	}
+}
@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// fakeEngine is a scriptable Engine. Installed files hold the version they
+// install; versions listed in broken crash loop instead of starting.
+type fakeEngine struct {
+	StartDelay time.Duration
+
+	mutex    sync.Mutex
+	state    DockerState
+	version  semver.Version
+	prev     *semver.Version
+	broken   map[string]bool
+	hung     bool
+	ready    chan struct{}
+	starts   int
+	stops    int
+	installs int
+}
+
+func newFakeEngine(version string) *fakeEngine {
+	return &fakeEngine{
+		state:   DockerStopped,
+		version: mustVersion(version),
+		broken:  map[string]bool{},
+		ready:   make(chan struct{}),
+	}
+}
+
+func (e *fakeEngine) Start() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.state == DockerStarting || e.state == DockerRunning {
+		return
+	}
+	e.starts++
+	e.hung = false
+	e.boot()
+}
+
+// boot brings the engine up after StartDelay. It must be called with the
+// mutex held.
+func (e *fakeEngine) boot() {
+	if e.broken[e.version.String()] {
+		e.state = DockerCrashLoop
+		return
+	}
+	e.state = DockerStarting
+	ready, delay := e.ready, e.StartDelay
+	go func() {
+		time.Sleep(delay)
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		if e.state == DockerStarting && e.ready == ready {
+			e.state = DockerRunning
+			close(ready)
+		}
+	}()
+}
+
+func (e *fakeEngine) Stop() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.state == DockerStopped {
+		return
+	}
+	e.stops++
+	e.state = DockerStopped
+	e.resetReady()
+}
+
+// resetReady must be called with the mutex held
+func (e *fakeEngine) resetReady() {
+	select {
+	case <-e.ready:
+		e.ready = make(chan struct{})
+	default:
+	}
+}
+
+// Crash kills the running engine, which is respawned like the supervisor does
+func (e *fakeEngine) Crash() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.resetReady()
+	e.boot()
+}
+
+// Hang makes the engine stop answering its API until it is restarted
+func (e *fakeEngine) Hang() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.hung = true
+}
+
+func (e *fakeEngine) State() DockerState {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.state
+}
+
+func (e *fakeEngine) Pid() int {
+	if e.State() == DockerRunning {
+		return 1
+	}
+	return 0
+}
+
+func (e *fakeEngine) WaitReady(timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	e.mutex.Lock()
+	ready := e.ready
+	e.mutex.Unlock()
+	select {
+	case <-ready:
+		return e.State() == DockerRunning
+	case <-expired:
+		return false
+	}
+}
+
+func (e *fakeEngine) Health(timeout time.Duration) (time.Duration, error) {
+	e.mutex.Lock()
+	state, hung := e.state, e.hung
+	e.mutex.Unlock()
+	if hung {
+		time.Sleep(timeout)
+		return timeout, errors.New("timeout")
+	}
+	if state != DockerRunning {
+		return 0, errors.New("connection refused")
+	}
+	return time.Millisecond, nil
+}
+
+func (e *fakeEngine) Version() semver.Version {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.version
+}
+
+func (e *fakeEngine) Install(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	v, err := semver.Make(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	prev := e.version
+	e.prev, e.version = &prev, v
+	e.installs++
+	return os.RemoveAll(file)
+}
+
+func (e *fakeEngine) Rollback() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.prev == nil {
+		return errors.New("no previous docker binary")
+	}
+	prev := e.version
+	e.version, e.prev = *e.prev, &prev
+	return nil
+}
@@ -0,0 +1,415 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DiskUsage is the usage of a filesystem, in percent of its space and of
+// its inodes
+type DiskUsage struct {
+	Space  int
+	Inodes int
+}
+
+func (u DiskUsage) max() int {
+	if u.Inodes > u.Space {
+		return u.Inodes
+	}
+	return u.Space
+}
+
+// readDiskUsage returns the usage of the filesystem holding dir
+func readDiskUsage(dir string) (DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(existingParent(dir), &stat); err != nil {
+		return DiskUsage{}, err
+	}
+	var usage DiskUsage
+	// like df, the space reserved to root is not counted as available
+	used := stat.Blocks - stat.Bfree
+	usage.Space = percentUp(used, used+stat.Bavail)
+	usage.Inodes = percentUp(stat.Files-stat.Ffree, stat.Files)
+	return usage, nil
+}
+
+func percentUp(used, total uint64) int {
+	if total == 0 {
+		return 0
+	}
+	return int((used*100 + total - 1) / total)
+}
+
+// GCDeletion is a container or an image removed by the garbage collector
+type GCDeletion struct {
+	Type   string    `json:"type"`
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// GarbageCollector removes exited containers and unused images once the
+// docker data root is used above HighWatermark percent, of either its space
+// or its inodes, until it gets below LowWatermark. Containers which exited
+// more than ContainerMinAge ago are removed first, oldest first, then the
+// images no container uses, least recently used first. Images not used
+// since the agent started are ordered by creation time.
+type GarbageCollector struct {
+	Interval        time.Duration
+	HighWatermark   int
+	LowWatermark    int
+	ContainerMinAge time.Duration
+	KeepImages      []string
+	KeepLabels      []string
+
+	usage    func() (DiskUsage, error)
+	report   func([]GCDeletion) error
+	lastUsed map[string]time.Time
+}
+
+func NewGarbageCollector() *GarbageCollector {
+	gc := &GarbageCollector{
+		Interval:        GCInterval * time.Second,
+		HighWatermark:   GCHighWatermark,
+		LowWatermark:    GCLowWatermark,
+		ContainerMinAge: GCContainerMinAge * time.Minute,
+		KeepImages:      Conf.GCKeepImages,
+		KeepLabels:      Conf.GCKeepLabels,
+		usage: func() (DiskUsage, error) {
+			return readDiskUsage(dockerRootDir())
+		},
+		report: func(deletions []GCDeletion) error {
+			return postNode(GCEndpoint, deletions)
+		},
+		lastUsed: map[string]time.Time{},
+	}
+	if Conf.GCHighWatermark > 0 {
+		gc.HighWatermark = Conf.GCHighWatermark
+	}
+	if Conf.GCLowWatermark > 0 {
+		gc.LowWatermark = Conf.GCLowWatermark
+	}
+	if Conf.GCContainerMinAge > 0 {
+		gc.ContainerMinAge = time.Duration(Conf.GCContainerMinAge) * time.Minute
+	}
+	if *FlagStandalone {
+		gc.report = nil
+	}
+	return gc
+}
+
+// CollectGarbage checks the disk usage every GCInterval seconds, forever,
+// if GCEnabled is set
+func CollectGarbage() {
+	if !Conf.GCEnabled {
+		return
+	}
+	gc := NewGarbageCollector()
+	Logger.Printf("Collecting docker garbage above %d%% of disk usage", gc.HighWatermark)
+	for {
+		time.Sleep(gc.Interval)
+		WaitDockerReady()
+		deletions, err := gc.Collect(time.Now())
+		if err != nil {
+			SendError(err, "Failed to collect docker garbage", nil)
+			Logger.Println("Cannot collect docker garbage:", err)
+		}
+		if len(deletions) == 0 || gc.report == nil {
+			continue
+		}
+		if err := gc.report(deletions); err != nil {
+			Logger.Println("Cannot report the docker garbage collection to Tutum:", err)
+		}
+	}
+}
+
+type gcContainer struct {
+	ID       string
+	Name     string
+	Image    string
+	Labels   map[string]string
+	Exited   bool
+	Finished time.Time
+}
+
+type gcImage struct {
+	ID       string
+	RepoTags []string
+	Labels   map[string]string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// lastUse returns when the image was last used by a container, or
+// when it was created if it was not used since the agent started
+func (image gcImage) lastUse() time.Time {
+	if image.LastUsed.IsZero() {
+		return image.Created
+	}
+	return image.LastUsed
+}
+
+// dockerRootDir returns the data root of the running docker daemon, which
+// may not be the one of the agent settings with an external docker
+func dockerRootDir() string {
+	body, err := dockerAPIGet("/info", DialTimeOut*time.Second)
+	if err == nil {
+		var info struct {
+			DockerRootDir string
+		}
+		if err := json.Unmarshal(body, &info); err == nil && info.DockerRootDir != "" {
+			return info.DockerRootDir
+		}
+	}
+	return dockerDataRoot()
+}
+
+// Collect removes garbage if the disk usage is above the high watermark,
+// and returns what was removed
+func (gc *GarbageCollector) Collect(now time.Time) ([]GCDeletion, error) {
+	containers, err := gc.listContainers()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		if !c.Exited {
+			gc.lastUsed[c.Image] = now
+		} else if gc.lastUsed[c.Image].Before(c.Finished) {
+			gc.lastUsed[c.Image] = c.Finished
+		}
+	}
+
+	usage, err := gc.usage()
+	if err != nil {
+		return nil, err
+	}
+	if usage.max() < gc.HighWatermark {
+		return nil, nil
+	}
+	Logger.Printf("Docker data root is %d%% full (%d%% of inodes), collecting garbage", usage.Space, usage.Inodes)
+
+	var deletions []GCDeletion
+	done := func(d GCDeletion) (bool, error) {
+		Logger.Printf("Removed %s %s (%s): %s", d.Type, d.Name, d.ID, d.Reason)
+		deletions = append(deletions, d)
+		usage, err := gc.usage()
+		if err != nil {
+			return true, err
+		}
+		return usage.max() < gc.LowWatermark, nil
+	}
+
+	inUse := map[string]bool{}
+	var exited []gcContainer
+	for _, c := range containers {
+		if c.Exited && now.Sub(c.Finished) >= gc.ContainerMinAge && !gc.keepLabels(c.Labels) {
+			exited = append(exited, c)
+		} else {
+			inUse[c.Image] = true
+		}
+	}
+	sort.Sort(byFinished(exited))
+	for i, c := range exited {
+		if _, err := dockerAPIDelete("/containers/"+c.ID, DialTimeOut*time.Second); err != nil {
+			Logger.Printf("Cannot remove container %s: %s", c.Name, err)
+			for _, c := range exited[i:] {
+				inUse[c.Image] = true
+			}
+			break
+		}
+		reason := fmt.Sprintf("exited %s ago", gcAge(now.Sub(c.Finished)))
+		if stop, err := done(GCDeletion{Type: "container", ID: c.ID, Name: c.Name, Time: now, Reason: reason}); stop {
+			return deletions, err
+		}
+	}
+
+	images, err := gc.listImages()
+	if err != nil {
+		return deletions, err
+	}
+	var unused []gcImage
+	for _, image := range images {
+		if !inUse[image.ID] && !gc.keepImage(image) {
+			unused = append(unused, image)
+		}
+	}
+	sort.Sort(byLastUsed(unused))
+	for _, image := range unused {
+		if err := removeImage(image); err != nil {
+			Logger.Printf("Cannot remove image %s: %s", image.name(), err)
+			continue
+		}
+		delete(gc.lastUsed, image.ID)
+		reason := "never used"
+		if !image.LastUsed.IsZero() {
+			reason = fmt.Sprintf("last used %s ago", gcAge(now.Sub(image.LastUsed)))
+		} else if !image.Created.IsZero() {
+			reason = fmt.Sprintf("unused, created %s ago", gcAge(now.Sub(image.Created)))
+		}
+		if stop, err := done(GCDeletion{Type: "image", ID: image.ID, Name: image.name(), Time: now, Reason: reason}); stop {
+			return deletions, err
+		}
+	}
+
+	if usage, err := gc.usage(); err == nil && usage.max() >= gc.LowWatermark {
+		Logger.Printf("Docker data root is still %d%% full (%d%% of inodes) after collecting garbage", usage.Space, usage.Inodes)
+	}
+	return deletions, nil
+}
+
+func (gc *GarbageCollector) listContainers() ([]gcContainer, error) {
+	body, err := dockerAPIGet("/containers/json?all=1", DialTimeOut*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		Id string
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+
+	var containers []gcContainer
+	for _, item := range list {
+		body, err := dockerAPIGet("/containers/"+item.Id+"/json", DialTimeOut*time.Second)
+		if err != nil {
+			// the container may have been removed since it was listed
+			Logger.Printf("Cannot inspect container %s, it will not be collected: %s", item.Id, err)
+			continue
+		}
+		var inspect struct {
+			Id     string
+			Name   string
+			Image  string
+			Config struct {
+				Labels map[string]string
+			}
+			State struct {
+				Running    bool
+				Restarting bool
+				FinishedAt time.Time
+			}
+		}
+		if err := json.Unmarshal(body, &inspect); err != nil {
+			Logger.Printf("Cannot inspect container %s, it will not be collected: %s", item.Id, err)
+			continue
+		}
+		state := inspect.State
+		containers = append(containers, gcContainer{
+			ID:     inspect.Id,
+			Name:   strings.TrimPrefix(inspect.Name, "/"),
+			Image:  inspect.Image,
+			Labels: inspect.Config.Labels,
+			// containers created but never started have no finish time
+			Exited:   !state.Running && !state.Restarting && state.FinishedAt.Year() > 1,
+			Finished: state.FinishedAt,
+		})
+	}
+	return containers, nil
+}
+
+func (gc *GarbageCollector) listImages() ([]gcImage, error) {
+	body, err := dockerAPIGet("/images/json", DialTimeOut*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	var list []struct {
+		Id       string
+		RepoTags []string
+		Labels   map[string]string
+		Created  int64
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	var images []gcImage
+	for _, item := range list {
+		image := gcImage{ID: item.Id, RepoTags: item.RepoTags, Labels: item.Labels, LastUsed: gc.lastUsed[item.Id]}
+		if item.Created > 0 {
+			image.Created = time.Unix(item.Created, 0)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// keepImage reports whether the image is in KeepImages, either by name
+// with any tag ("nginx") or with a given tag ("nginx:1.9"), or has one of
+// KeepLabels
+func (gc *GarbageCollector) keepImage(image gcImage) bool {
+	for _, tag := range image.RepoTags {
+		repo := tag
+		if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+			repo = tag[:i]
+		}
+		for _, keep := range gc.KeepImages {
+			if keep == tag || keep == repo {
+				return true
+			}
+		}
+	}
+	return gc.keepLabels(image.Labels)
+}
+
+// keepLabels reports whether labels match one of KeepLabels, either by key
+// ("keep") or by key and value ("keep=true")
+func (gc *GarbageCollector) keepLabels(labels map[string]string) bool {
+	for _, keep := range gc.KeepLabels {
+		parts := strings.SplitN(keep, "=", 2)
+		value, ok := labels[parts[0]]
+		if ok && (len(parts) == 1 || parts[1] == value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (image gcImage) name() string {
+	for _, tag := range image.RepoTags {
+		if tag != "<none>:<none>" {
+			return tag
+		}
+	}
+	return image.ID
+}
+
+// removeImage untags the image, removing it with its last tag, as removing
+// an image with several tags by ID is refused by docker
+func removeImage(image gcImage) error {
+	tagged := false
+	for _, tag := range image.RepoTags {
+		if tag == "<none>:<none>" {
+			continue
+		}
+		tagged = true
+		if _, err := dockerAPIDelete("/images/"+tag, DialTimeOut*time.Second); err != nil {
+			return err
+		}
+	}
+	if tagged {
+		return nil
+	}
+	_, err := dockerAPIDelete("/images/"+image.ID, DialTimeOut*time.Second)
+	return err
+}
+
+func gcAge(d time.Duration) string {
+	return (d / time.Minute * time.Minute).String()
+}
+
+type byFinished []gcContainer
+
+func (s byFinished) Len() int           { return len(s) }
+func (s byFinished) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byFinished) Less(i, j int) bool { return s[i].Finished.Before(s[j].Finished) }
+
+type byLastUsed []gcImage
+
+func (s byLastUsed) Len() int           { return len(s) }
+func (s byLastUsed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastUsed) Less(i, j int) bool { return s[i].lastUse().Before(s[j].lastUse()) }
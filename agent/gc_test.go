@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGarbageCollector(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	containers := map[string]string{
+		"running": `{"Id":"running","Name":"/web","Image":"img-web","State":{"Running":true}}`,
+		"old":     fmt.Sprintf(`{"Id":"old","Name":"/old","Image":"img-old","State":{"FinishedAt":%q}}`, now.Add(-3*time.Hour).Format(time.RFC3339Nano)),
+		"older":   fmt.Sprintf(`{"Id":"older","Name":"/older","Image":"img-web","State":{"FinishedAt":%q}}`, now.Add(-5*time.Hour).Format(time.RFC3339Nano)),
+		"recent":  fmt.Sprintf(`{"Id":"recent","Name":"/recent","Image":"img-recent","State":{"FinishedAt":%q}}`, now.Add(-time.Minute).Format(time.RFC3339Nano)),
+		"kept":    fmt.Sprintf(`{"Id":"kept","Name":"/kept","Image":"img-kept","Config":{"Labels":{"gc":"keep"}},"State":{"FinishedAt":%q}}`, now.Add(-5*time.Hour).Format(time.RFC3339Nano)),
+		"created": `{"Id":"created","Name":"/created","Image":"img-created","State":{"FinishedAt":"0001-01-01T00:00:00Z"}}`,
+		// removed after it was listed, which does not stop the collection
+		"gone": "",
+	}
+	images := `[{"Id":"img-web","RepoTags":["web:latest"]},{"Id":"img-old","RepoTags":["old:1","old:2"]},` +
+		`{"Id":"img-recent","RepoTags":["recent:latest"]},{"Id":"img-kept","RepoTags":["kept:latest"]},` +
+		`{"Id":"img-created","RepoTags":["created:latest"]},{"Id":"img-dangling","RepoTags":["<none>:<none>"]},` +
+		`{"Id":"img-base","RepoTags":["base:1.0"]},{"Id":"img-label","RepoTags":["label:latest"],"Labels":{"gc":"keep"}},` +
+		fmt.Sprintf(`{"Id":"img-ancient","RepoTags":["ancient:1"],"Created":%d}]`, now.Add(-48*time.Hour).Unix())
+
+	var mutex sync.Mutex
+	var deleted []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/containers/json" {
+			var list []string
+			for id := range containers {
+				list = append(list, fmt.Sprintf(`{"Id":%q}`, id))
+			}
+			fmt.Fprintf(w, "[%s]", strings.Join(list, ","))
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		if r.Method == "DELETE" {
+			delete(containers, id)
+			deleted = append(deleted, "container "+id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if containers[id] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, containers[id])
+	})
+	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/images/json" {
+			fmt.Fprint(w, images)
+			return
+		}
+		deleted = append(deleted, "image "+strings.TrimPrefix(r.URL.Path, "/images/"))
+		fmt.Fprint(w, "[]")
+	})
+	defer serveFakeDocker(t, mux)()
+
+	// every container or image removed frees 5% of the disk, until the
+	// dangling image which frees nothing
+	usage := 90
+	removals := 0
+	gc := &GarbageCollector{
+		HighWatermark:   85,
+		LowWatermark:    70,
+		ContainerMinAge: time.Hour,
+		KeepImages:      []string{"base"},
+		KeepLabels:      []string{"gc=keep"},
+		usage: func() (DiskUsage, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(deleted) > removals {
+				usage -= 5
+				removals = len(deleted)
+			}
+			return DiskUsage{Space: usage, Inodes: 10}, nil
+		},
+		lastUsed: map[string]time.Time{"img-dangling": now.Add(-24 * time.Hour)},
+	}
+
+	deletions, err := gc.Collect(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"container older",
+		"container old",
+		"image ancient:1",
+		"image img-dangling",
+		"image old:1",
+		"image old:2",
+	}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("expected %v to be removed, got %v", expected, deleted)
+	}
+	if len(deletions) != 5 || deletions[0].Reason != "exited 5h0m0s ago" || deletions[2].Reason != "unused, created 48h0m0s ago" ||
+		deletions[3].Name != "img-dangling" || deletions[4].Name != "old:1" || deletions[4].Reason != "last used 3h0m0s ago" {
+		t.Errorf("unexpected deletions %+v", deletions)
+	}
+
+	// nothing is removed below the high watermark
+	deleted = nil
+	if deletions, err := gc.Collect(now); err != nil || len(deletions) != 0 || len(deleted) != 0 {
+		t.Errorf("expected nothing to be removed, got %v, %v", deleted, err)
+	}
+}
+
+func TestGCKeepImage(t *testing.T) {
+	gc := &GarbageCollector{KeepImages: []string{"nginx", "localhost:5000/app:1.0"}, KeepLabels: []string{"keep"}}
+	for _, test := range []struct {
+		image gcImage
+		keep  bool
+	}{
+		{gcImage{RepoTags: []string{"nginx:1.9"}}, true},
+		{gcImage{RepoTags: []string{"nginx-proxy:latest"}}, false},
+		{gcImage{RepoTags: []string{"localhost:5000/app:1.0"}}, true},
+		{gcImage{RepoTags: []string{"localhost:5000/app:2.0"}}, false},
+		{gcImage{RepoTags: []string{"other:latest"}, Labels: map[string]string{"keep": ""}}, true},
+	} {
+		if keep := gc.keepImage(test.image); keep != test.keep {
+			t.Errorf("%v: expected keep to be %v", test.image.RepoTags, test.keep)
+		}
+	}
+}
+
+func TestDockerRootDir(t *testing.T) {
+	oldConf := Conf
+	defer func() { Conf = oldConf }()
+	Conf = Configuration{DockerGraph: "/data/docker"}
+
+	stop := serveFakeDocker(t, http.NotFoundHandler())
+	if dir := dockerRootDir(); dir != "/data/docker" {
+		t.Errorf("expected the configured data root without /info, got %s", dir)
+	}
+	stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"DockerRootDir":"/var/lib/docker-external"}`)
+	})
+	defer serveFakeDocker(t, mux)()
+	if dir := dockerRootDir(); dir != "/var/lib/docker-external" {
+		t.Errorf("expected the data root of the daemon, got %s", dir)
+	}
+}
@@ -6,27 +6,49 @@ import (
 )
 
 var (
-	FlagDebugMode     *bool
-	FlagLogToStdout   *bool
-	FlagStandalone    *bool
-	FlagSkipNatTunnel *bool
-	FlagDockerHost    *string
-	FlagDockerOpts    *string
-	FlagTutumHost     *string
-	FlagTutumToken    *string
-	FlagTutumUUID     *string
-	FlagNgrokToken    *string
-	FlagNgrokHost     *string
-	FlagVersion       *bool
-
-	Conf                      Configuration
-	Logger                    *log.Logger
-	DockerProcess             *os.Process
-	ScheduleToTerminateDocker = false
-	ScheduledShutdown         = false
-	DockerBinaryURL           = "https://files.tutum.co/packages/docker/latest.json"
-	NgrokBinaryURL            = ""
-	NgrokHost                 = ""
+	FlagDebugMode      *bool
+	FlagLogToStdout    *bool
+	FlagStandalone     *bool
+	FlagSkipNatTunnel  *bool
+	FlagDockerHost     *string
+	FlagDockerOpts     *string
+	FlagTutumHost      *string
+	FlagTutumToken     *string
+	FlagTutumUUID      *string
+	FlagNgrokToken     *string
+	FlagNgrokHost      *string
+	FlagVersion        *bool
+	FlagRoot           *string
+	FlagTutumHome      *string
+	FlagDockerDir      *string
+	FlagLogDir         *string
+	FlagPidFile        *string
+	FlagDockerSymlink  *string
+	FlagExternalDocker *bool
+
+	Conf                Configuration
+	Logger              *log.Logger
+	Docker              Engine
+	DockerCgroupManager *DockerCgroup
+	ScheduledShutdown   = false
+	DockerBinaryURL     = "https://files.tutum.co/packages/docker/latest.json"
+	NgrokBinaryURL      = ""
+	NgrokHost           = ""
+
+	// Sockets passed by systemd socket activation, handed to docker
+	DockerActivatedSockets []*os.File
+
+	// Locations used by the agent, relocatable with SetPaths
+	TutumHome           = defaultTutumHome
+	DockerDir           = defaultDockerDir
+	LogDir              = defaultLogDir
+	TutumPidFile        = defaultTutumPidFile
+	DockerSymbolicLink  = defaultDockerSymbolicLink
+	DockerDefaultHost   = "unix://" + defaultDockerSocket
+	DockerPidFile       = defaultDockerPidFile
+	DockerDataRoot      = defaultDockerDataRoot
+	DockerSystemdDropIn = defaultDockerSystemdDropIn
+	DockerClientConfig  = defaultDockerClientConfig
 )
 
 const (
@@ -37,11 +59,19 @@ const (
 )
 
 const (
-	TutumHome = "/etc/tutum/agent"
-	DockerDir = "/usr/lib/tutum"
-	LogDir    = "/var/log/tutum"
+	defaultTutumHome          = "/etc/tutum/agent"
+	defaultDockerDir          = "/usr/lib/tutum"
+	defaultLogDir             = "/var/log/tutum"
+	defaultTutumPidFile       = "/var/run/tutum-agent.pid"
+	defaultDockerSymbolicLink = "/usr/bin/docker"
+	defaultDockerSocket       = "/var/run/docker.sock"
+	defaultDockerPidFile      = "/var/run/docker.pid"
+
+	defaultDockerDataRoot         = "/var/lib/docker"
+	defaultDockerDaemonConfigBase = "/etc/docker/daemon.json"
+	defaultDockerSystemdDropIn    = "/etc/systemd/system/docker.service.d/tutum-agent.conf"
+	defaultDockerClientConfig     = "/root/.docker/config.json"
 
-	DockerSymbolicLink     = "/usr/bin/docker"
 	DockerLogFileName      = "docker.log"
 	TutumLogFileName       = "agent.log"
 	KeyFileName            = "key.pem"
@@ -51,20 +81,74 @@ const (
 	DockerBinaryName       = "docker"
 	DockerNewBinaryName    = "docker.new"
 	DockerNewBinarySigName = "docker.new.sig"
+	DockerPrevBinaryName   = "docker.prev"
+	DockerRollbackName     = "docker.rollback"
+	DockerUpgradeNowName   = "docker.upgrade-now"
+	DockerDaemonConfigName = "daemon.json"
+	ContainerSnapshotName  = "containers.json"
+	EventsBufferName       = "events.buffer"
+	ContainerLogFileName   = "containers.log"
+	RegistriesFileName     = "registries.json"
+	MetricsFileName        = "metrics.json"
 	NgrokBinaryName        = "ngrok"
 	NgrokLogName           = "ngrok.log"
 	NgrokConfName          = "ngrok.conf"
-	TutumPidFile           = "/var/run/tutum-agent.pid"
 
-	RegEndpoint       = "api/agent/node/"
-	DockerDefaultHost = "unix:///var/run/docker.sock"
+	RegEndpoint           = "api/agent/node/"
+	EventsEndpoint        = "events/"
+	MetricsEndpoint       = "metrics/"
+	ContainerLogsEndpoint = "logs/"
+	GCEndpoint            = "gc/"
 
 	MaxWaitingTime    = 200 //seconds
 	HeartBeatInterval = 5   //seconds
 
+	RegistryCredentialsSyncInterval = 60 //seconds
+
 	RenicePriority  = -10
 	ReniceSleepTime = 5 //seconds
 
+	ContainerOOMScoreAdj = 0
+
+	DockerCrashLoopCount   = 5  //crashes
+	DockerCrashLoopWindow  = 10 //minutes
+	DockerBackoffResetTime = 60 //seconds
+	DockerStopTimeout      = 30 //seconds
+	DockerKillTimeout      = 10 //seconds
+
+	DockerUpgradeHealthTimeout = 120  //seconds
+	DockerUpgradeCheckInterval = 3600 //seconds
+
+	DockerDaemonLogMaxSize   = 10  //MB
+	DockerDaemonLogMaxAge    = 168 //hours
+	DockerDaemonLogRetention = 5   //rotated files
+	DockerDaemonLogTailLines = 100 //lines kept in memory
+
+	DockerHealthCheckInterval  = 30 //seconds
+	DockerHealthCheckTimeout   = 10 //seconds
+	DockerHealthCheckRetries   = 3
+	DockerHealthReportInterval = 300 //seconds
+
+	PreflightMinFreeDisk = 2048 //MB
+
+	EventsBatchSize     = 100   //events
+	EventsFlushInterval = 5     //seconds
+	EventsBufferMax     = 10000 //events
+
+	MetricsCollectInterval  = 60   //seconds
+	MetricsPushInterval     = 300  //seconds
+	MetricsRetention        = 3600 //seconds
+	MetricsStatsConcurrency = 4    //containers
+
+	ContainerLogBatchSize     = 100 //lines
+	ContainerLogFlushInterval = 1   //seconds
+	ContainerLogRateLimit     = 100 //lines per second and container
+
+	GCInterval        = 300 //seconds
+	GCHighWatermark   = 85  //percent of disk space or inodes
+	GCLowWatermark    = 75  //percent of disk space or inodes
+	GCContainerMinAge = 60  //minutes
+
 	DockerHostPort = "2375"
 
 	DialTimeOut = 10 //seconds
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DockerHealthChecker periodically queries the docker API, and restarts the
+// daemon after Retries consecutive failures, as a daemon which is alive but
+// deadlocked is otherwise never noticed. The result of the checks is
+// reported every ReportInterval, and as soon as docker becomes unhealthy or
+// healthy again.
+type DockerHealthChecker struct {
+	Interval       time.Duration
+	Timeout        time.Duration
+	Retries        int
+	ReportInterval time.Duration
+
+	mutex          sync.Mutex
+	failures       int
+	lastCheck      time.Time
+	latency        time.Duration
+	lastError      error
+	cgroup         *CgroupUsage
+	lastReport     time.Time
+	reportedFailed bool
+
+	check   func(timeout time.Duration) (time.Duration, error)
+	running func() bool
+	restart func(err error)
+	report  func(health DockerHealth)
+}
+
+// DockerHealth is a snapshot of the last docker health check
+type DockerHealth struct {
+	LastCheck time.Time
+	Latency   time.Duration
+	Failures  int
+	Error     string
+	Cgroup    *CgroupUsage
+}
+
+func NewDockerHealthChecker(engine Engine) *DockerHealthChecker {
+	h := &DockerHealthChecker{
+		Interval:       DockerHealthCheckInterval * time.Second,
+		Timeout:        DockerHealthCheckTimeout * time.Second,
+		Retries:        DockerHealthCheckRetries,
+		ReportInterval: DockerHealthReportInterval * time.Second,
+		check:          engine.Health,
+		running: func() bool {
+			return engine.State() == DockerRunning
+		},
+		restart: func(err error) {
+			restartUnhealthyDocker(engine, err)
+		},
+		report: ReportDockerHealth,
+	}
+	if Conf.DockerHealthCheckInterval > 0 {
+		h.Interval = time.Duration(Conf.DockerHealthCheckInterval) * time.Second
+	}
+	if Conf.DockerHealthCheckTimeout > 0 {
+		h.Timeout = time.Duration(Conf.DockerHealthCheckTimeout) * time.Second
+	}
+	if Conf.DockerHealthCheckRetries > 0 {
+		h.Retries = Conf.DockerHealthCheckRetries
+	}
+	return h
+}
+
+// Run checks the docker daemon every Interval, forever
+func (h *DockerHealthChecker) Run() {
+	for {
+		time.Sleep(h.Interval)
+		h.CheckOnce()
+	}
+}
+
+// CheckOnce runs a single health check, restarting docker if it failed too
+// many times in a row. Checks are skipped while docker is not running, and
+// ignored if docker was upgraded, rolled back or restarted meanwhile.
+func (h *DockerHealthChecker) CheckOnce() {
+	generation := dockerLifecycle.Generation()
+	if !h.running() {
+		h.mutex.Lock()
+		h.failures = 0
+		h.mutex.Unlock()
+		return
+	}
+
+	latency, err := h.check(h.Timeout)
+	cgroup := dockerCgroupUsage()
+	if err != nil && dockerLifecycle.Generation() != generation {
+		Logger.Println("Ignoring the docker health check which overlapped a restart of docker:", err)
+		return
+	}
+
+	h.mutex.Lock()
+	h.lastCheck = time.Now()
+	h.cgroup = cgroup
+	h.latency = latency
+	h.lastError = err
+	report := (err != nil) != h.reportedFailed || h.lastCheck.Sub(h.lastReport) >= h.ReportInterval
+	if report {
+		h.lastReport = h.lastCheck
+		h.reportedFailed = err != nil
+	}
+	if err == nil {
+		if h.failures > 0 {
+			Logger.Printf("Docker daemon is healthy again (latency: %s)", latency)
+		}
+		h.failures = 0
+	} else {
+		h.failures++
+	}
+	health := h.health()
+	failures := h.failures
+	restart := err != nil && failures >= h.Retries
+	if restart {
+		h.failures = 0
+	}
+	h.mutex.Unlock()
+
+	if report && h.report != nil {
+		h.report(health)
+	}
+	if err == nil {
+		return
+	}
+
+	Logger.Printf("Docker health check failed (%d/%d): %s", failures, h.Retries, err)
+	if restart {
+		if !dockerLifecycle.LockSince(generation) {
+			Logger.Println("Docker was restarted during the health check, not restarting it again")
+			return
+		}
+		defer dockerLifecycle.Unlock()
+		h.restart(fmt.Errorf("docker failed %d consecutive health checks: %s", failures, err))
+	}
+}
+
+// Health returns the result of the last health check
+func (h *DockerHealthChecker) Health() DockerHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.health()
+}
+
+// health must be called with the mutex held
+func (h *DockerHealthChecker) health() DockerHealth {
+	health := DockerHealth{LastCheck: h.lastCheck, Latency: h.latency, Failures: h.failures, Cgroup: h.cgroup}
+	if h.lastError != nil {
+		health.Error = h.lastError.Error()
+	}
+	return health
+}
+
+// checkDockerHealth calls /_ping and /info, and returns the time both took
+func checkDockerHealth(timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	if err := pingDocker(timeout); err != nil {
+		return time.Since(start), err
+	}
+	body, err := dockerAPIGet("/info", timeout)
+	if err != nil {
+		return time.Since(start), err
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return time.Since(start), fmt.Errorf("invalid /info response: %s", err)
+	}
+	return time.Since(start), nil
+}
+
+func restartUnhealthyDocker(engine Engine, err error) {
+	Logger.Println("Restarting unhealthy docker daemon:", err)
+	extra := map[string]interface{}{"docker-log": tailDockerLog()}
+	if tree, treeErr := DockerProcessTree(); treeErr == nil {
+		extra["docker-process-tree"] = tree.String()
+	}
+	if usage := dockerCgroupUsage(); usage != nil {
+		extra["docker-cgroup-usage"] = *usage
+	}
+	SendError(err, "Docker daemon is unhealthy, restarting it", extra)
+	snapshot := SnapshotContainers()
+	engine.Stop()
+	engine.Start()
+	if err := waitEngineHealthy(engine, upgradeHealthTimeout); err != nil {
+		Logger.Println("Docker daemon is still unhealthy after restart:", err)
+		return
+	}
+	snapshot.Restore()
+}
+
+// dockerCgroupUsage returns the resource usage of the docker cgroup, or nil
+// if docker is not placed in a dedicated cgroup
+func dockerCgroupUsage() *CgroupUsage {
+	if DockerCgroupManager == nil {
+		return nil
+	}
+	usage, err := DockerCgroupManager.Usage()
+	if err != nil {
+		return nil
+	}
+	if *FlagDebugMode {
+		Logger.Printf("Docker cgroup %s: memory %d bytes, cpu %d us", usage.Path, usage.MemoryUsage, usage.CPUUsage)
+	}
+	return &usage
+}
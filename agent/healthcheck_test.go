@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestDockerHealthChecker(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+
+	var checkErr error
+	running := true
+	restarts := 0
+	var reports []DockerHealth
+	h := &DockerHealthChecker{
+		Retries:        3,
+		ReportInterval: time.Hour,
+		check: func(timeout time.Duration) (time.Duration, error) {
+			return time.Millisecond, checkErr
+		},
+		running: func() bool { return running },
+		restart: func(err error) { restarts++ },
+		report:  func(health DockerHealth) { reports = append(reports, health) },
+	}
+
+	h.CheckOnce()
+	if health := h.Health(); health.Error != "" || health.Latency != time.Millisecond {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+
+	checkErr = errors.New("timeout")
+	h.CheckOnce()
+	h.CheckOnce()
+	if restarts != 0 {
+		t.Fatal("Unexpected restart before reaching the retries")
+	}
+	if health := h.Health(); health.Failures != 2 || health.Error != "timeout" {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+	h.CheckOnce()
+	if restarts != 1 {
+		t.Fatal("Expected a restart after 3 consecutive failures, got", restarts)
+	}
+
+	// the first check and the first failure are reported
+	if len(reports) != 2 || reports[0].Error != "" || reports[1].Failures != 1 || reports[1].Error != "timeout" {
+		t.Fatalf("Unexpected reports: %+v", reports)
+	}
+
+	// failures are not consecutive when a check succeeds in between
+	h.CheckOnce()
+	checkErr = nil
+	h.CheckOnce()
+	checkErr = errors.New("timeout")
+	h.CheckOnce()
+	h.CheckOnce()
+	if restarts != 1 {
+		t.Fatal("Unexpected restart with non consecutive failures")
+	}
+	if len(reports) != 4 || reports[2].Error != "" || reports[3].Error != "timeout" {
+		t.Fatalf("Expected the recovery and the new failure to be reported, got %+v", reports)
+	}
+
+	// failures are forgotten while docker is not running
+	running = false
+	h.CheckOnce()
+	running = true
+	h.CheckOnce()
+	if health := h.Health(); health.Failures != 1 {
+		t.Fatalf("Unexpected health: %+v", health)
+	}
+}
@@ -17,9 +17,10 @@ import (
 
 type TargetDef struct {
 	Version             string `json:"version"`
-	Download_url        string `json: "download_url"`
-	Checksum_md5_url    string `json: "checksum_md5_url"`
-	Checksum_sha256_url string `json: "checksum_sha256_url"`
+	Download_url        string `json:"download_url"`
+	Checksum_md5_url    string `json:"checksum_md5_url"`
+	Checksum_sha256_url string `json:"checksum_sha256_url"`
+	Signature_url       string `json:"signature_url"`
 }
 
 func SendRequest(method, url string, data_bytes []byte, headers []string) ([]byte, error) {
@@ -67,7 +68,7 @@ func SendRequest(method, url string, data_bytes []byte, headers []string) ([]byt
 		if *FlagDebugMode {
 			Logger.Println("=======Response Info ======")
 			Logger.Println("=> Headers:", resp.Header)
-			Logger.Println("=> Body:", string(body))
+			Logger.Println("=> Body:", redactResponseBody(body))
 		}
 		return body, nil
 	default:
@@ -75,13 +76,31 @@ func SendRequest(method, url string, data_bytes []byte, headers []string) ([]byt
 			Logger.Println("=======Response Info (ERROR) ======")
 			Logger.Println("=> Headers:", resp.Header)
 			b, _ := ioutil.ReadAll(resp.Body)
-			Logger.Println("=> Body:", string(b))
+			Logger.Println("=> Body:", redactResponseBody(b))
 		}
 		err_msg := fmt.Sprintf("%d", resp.StatusCode)
 		return nil, errors.New(err_msg)
 	}
 }
 
+// redactResponseBody returns body for the debug log, without the registry
+// credentials delivered by Tutum
+func redactResponseBody(body []byte) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return string(body)
+	}
+	if _, ok := fields["registry_credentials"]; !ok {
+		return string(body)
+	}
+	fields["registry_credentials"] = json.RawMessage(`"<redacted>"`)
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return "<redacted>"
+	}
+	return string(redacted)
+}
+
 func HttpGet(url string) ([]byte, error) {
 	resp, err := http.Get(url)
 	if err != nil {
@@ -163,10 +182,17 @@ func downloadTarget(def *TargetDef) []byte {
 }
 
 func getTarget(def *TargetDef) ([]byte, error) {
+	b, _, err := getSignedTarget(def)
+	return b, err
+}
+
+// getSignedTarget downloads the target of def and checks it, and returns it
+// with its signature, nil if the target is not signed
+func getSignedTarget(def *TargetDef) ([]byte, []byte, error) {
 	b, err := HttpGet(def.Download_url)
 	if err != nil {
 		SendError(err, "HTTP get error", nil)
-		return nil, err
+		return nil, nil, err
 	}
 
 	//validate md5 checksum of the target
@@ -177,11 +203,11 @@ func getTarget(def *TargetDef) ([]byte, error) {
 	if err != nil {
 		SendError(err, "HTTP get error", nil)
 		Logger.Println("Failed to get md5 for the target")
-		return nil, err
+		return nil, nil, err
 	} else {
 		if !strings.Contains(string(md5b), md5s) {
 			SendError(errors.New("Failed to pass md5 checksum test"), "Failed on md5 checksum test", nil)
-			return nil, errors.New("Failed to pass md5 checksum test")
+			return nil, nil, errors.New("Failed to pass md5 checksum test")
 		}
 	}
 
@@ -193,15 +219,29 @@ func getTarget(def *TargetDef) ([]byte, error) {
 	if err != nil {
 		SendError(err, "HTTP error", nil)
 		Logger.Println("Failed to get sha256 for the target")
-		return nil, err
+		return nil, nil, err
 	} else {
 		if !strings.Contains(string(sha256b), sha256s) {
 			SendError(errors.New("Failed to pass sha256 checksum test"), "Failed on sha256 checksum test", nil)
-			return nil, errors.New("Failed to pass sha256 checksum test")
+			return nil, nil, errors.New("Failed to pass sha256 checksum test")
+		}
+	}
+
+	//validate the signature of the target, if signed
+	var sig []byte
+	if def.Signature_url != "" {
+		sig, err = HttpGet(def.Signature_url)
+		if err != nil {
+			SendError(err, "HTTP error", nil)
+			Logger.Println("Failed to get the signature of the target")
+			return nil, nil, err
+		}
+		if err := verifyArtifact(def.Download_url, b, sig); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return b, nil
+	return b, sig, nil
 }
 
 func writeToFile(binary []byte, path string) {
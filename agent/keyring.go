@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"errors"
+	"os/exec"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// TutumKeyID is the ID of the Tutum public key
+const TutumKeyID = "A87A2270"
+
+// tutumKeyring is the armored public key (A87A2270) trusted to sign the
+// artifacts downloaded by the agent. It is updated with contrib/make-keyring.sh,
+// which checks the fingerprint of the key; while empty, the key imported in
+// the gpg keyring of root by install-agent.sh is trusted instead.
+const tutumKeyring = ``
+
+// overridable by tests
+var exportSystemTutumKey = func() ([]byte, error) {
+	return exec.Command("gpg", "--batch", "--export", TutumKeyID).Output()
+}
+
+// loadSystemTutumKey reads the Tutum key from the gpg keyring of root
+func loadSystemTutumKey() (openpgp.EntityList, error) {
+	data, err := exportSystemTutumKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("key " + TutumKeyID + " not found in the gpg keyring")
+	}
+	return readKeyring(data)
+}
@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow is a time range on some days of the week, such as
+// "Mon-Fri 22:00-02:00". Ranges ending before they start span midnight,
+// and belong to the day they start on.
+type MaintenanceWindow struct {
+	Days  [7]bool
+	Start int //minutes after midnight
+	End   int //minutes after midnight
+}
+
+// ParseMaintenanceWindow parses "<days> <HH:MM>-<HH:MM>", where days is "*",
+// a day ("Sat"), a range ("Mon-Fri") or a list of them ("Sat,Sun")
+func ParseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	var w MaintenanceWindow
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("%q is not in \"<days> <HH:MM>-<HH:MM>\" format", s)
+	}
+	if err := w.parseDays(fields[0]); err != nil {
+		return w, fmt.Errorf("%q: %s", s, err)
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return w, fmt.Errorf("%q: %q is not a time range", s, fields[1])
+	}
+	var err error
+	if w.Start, err = parseClock(times[0]); err != nil {
+		return w, fmt.Errorf("%q: %s", s, err)
+	}
+	if w.End, err = parseClock(times[1]); err != nil {
+		return w, fmt.Errorf("%q: %s", s, err)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("%q: empty time range", s)
+	}
+	return w, nil
+}
+
+func (w *MaintenanceWindow) parseDays(days string) error {
+	if days == "*" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+		return nil
+	}
+	for _, item := range strings.Split(days, ",") {
+		bounds := strings.Split(strings.ToLower(item), "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("%q is not a day range", item)
+		}
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("%q is not a day", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("%q is not a day", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("%q is not in HH:MM format", s)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("%q is not in HH:MM format", s)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("%q is not in HH:MM format", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Contains reports whether t, in the timezone of the window, is within it
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return w.Days[t.Weekday()] && minute >= w.Start && minute < w.End
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.Days[t.Weekday()] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End)
+}
+
+// MaintenancePolicy holds staged docker upgrades until one of its windows
+// opens. A policy without windows is always open.
+type MaintenancePolicy struct {
+	Windows  []MaintenanceWindow
+	Location *time.Location
+}
+
+// GetMaintenancePolicy builds the policy from DockerMaintenanceWindows and
+// DockerMaintenanceTimezone
+func GetMaintenancePolicy(conf Configuration) (*MaintenancePolicy, error) {
+	policy := &MaintenancePolicy{Location: time.Local}
+	if conf.DockerMaintenanceTimezone != "" {
+		location, err := time.LoadLocation(conf.DockerMaintenanceTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("DockerMaintenanceTimezone: %s", err)
+		}
+		policy.Location = location
+	}
+	for _, s := range conf.DockerMaintenanceWindows {
+		w, err := ParseMaintenanceWindow(s)
+		if err != nil {
+			return nil, fmt.Errorf("DockerMaintenanceWindows: %s", err)
+		}
+		policy.Windows = append(policy.Windows, w)
+	}
+	return policy, nil
+}
+
+// IsOpen reports whether upgrades can be applied at t
+func (p *MaintenancePolicy) IsOpen(t time.Time) bool {
+	if len(p.Windows) == 0 {
+		return true
+	}
+	t = t.In(p.Location)
+	for _, w := range p.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns when the next window opens after t, or t if open already
+func (p *MaintenancePolicy) NextOpen(t time.Time) time.Time {
+	next := t.Truncate(time.Minute)
+	for i := 0; i <= 8*24*60; i++ {
+		if p.IsOpen(next) {
+			if next.Before(t) {
+				return t
+			}
+			return next
+		}
+		next = next.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+type DockerUpgradeStatus struct {
+	Pending    bool   `json:"pending"`
+	NextWindow string `json:"next_window,omitempty"`
+}
+
+var (
+	pendingUpgrade       bool
+	pendingUpgradeWindow time.Time
+	pendingUpgradeMutex  sync.Mutex
+
+	// overridable by tests
+	reportDockerUpgrade = ReportDockerUpgrade
+)
+
+// dockerUpgradeAllowed reports whether the staged docker upgrade can be
+// applied now, either because a maintenance window is open or because
+// "tutum-agent docker upgrade-now" was called. Held upgrades are reported
+// to Tutum, again whenever the next window changes.
+func dockerUpgradeAllowed(dockerUpgradeNowPath string, now time.Time) bool {
+	pendingUpgradeMutex.Lock()
+	defer pendingUpgradeMutex.Unlock()
+
+	allowed := false
+	if utils.FileExist(dockerUpgradeNowPath) {
+		Logger.Println("Docker upgrade requested outside of maintenance windows")
+		os.RemoveAll(dockerUpgradeNowPath)
+		allowed = true
+	} else if policy, err := GetMaintenancePolicy(Conf); err != nil {
+		Logger.Println("Invalid maintenance windows, applying the docker upgrade:", err)
+		allowed = true
+	} else if policy.IsOpen(now) {
+		allowed = true
+	} else if next := policy.NextOpen(now); !pendingUpgrade || !next.Equal(pendingUpgradeWindow) {
+		Logger.Println("Docker upgrade staged, holding it until the maintenance window opens at", next)
+		reportDockerUpgrade(DockerUpgradeStatus{Pending: true, NextWindow: next.Format(time.RFC3339)})
+		pendingUpgrade = true
+		pendingUpgradeWindow = next
+	}
+
+	if allowed {
+		clearPendingDockerUpgrade()
+	}
+	return allowed
+}
+
+// clearPendingDockerUpgrade reports that no docker upgrade is held anymore,
+// once applied or when the staged binary was removed. It must be called
+// with pendingUpgradeMutex held.
+func clearPendingDockerUpgrade() {
+	if pendingUpgrade {
+		reportDockerUpgrade(DockerUpgradeStatus{Pending: false})
+		pendingUpgrade = false
+		pendingUpgradeWindow = time.Time{}
+	}
+}
+
+// dockerUpgradeGone clears the held upgrade when no binary is staged
+func dockerUpgradeGone() {
+	pendingUpgradeMutex.Lock()
+	defer pendingUpgradeMutex.Unlock()
+	clearPendingDockerUpgrade()
+}
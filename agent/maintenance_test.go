@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		days   []time.Weekday
+		start  int
+		end    int
+	}{
+		{"Sat 02:00-06:00", []time.Weekday{time.Saturday}, 120, 360},
+		{"Mon-Fri 22:00-02:00", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, 1320, 120},
+		{"sat,Sun 00:00-24:00", []time.Weekday{time.Saturday, time.Sunday}, 0, 1440},
+		{"Fri-Mon 01:30-02:45", []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, 90, 165},
+		{"* 03:00-04:00", []time.Weekday{0, 1, 2, 3, 4, 5, 6}, 180, 240},
+	}
+	for _, test := range tests {
+		w, err := ParseMaintenanceWindow(test.window)
+		if err != nil {
+			t.Errorf("%s: %s", test.window, err)
+			continue
+		}
+		var days [7]bool
+		for _, d := range test.days {
+			days[d] = true
+		}
+		if w.Days != days || w.Start != test.start || w.End != test.end {
+			t.Errorf("%s: unexpected window %+v", test.window, w)
+		}
+	}
+
+	for _, invalid := range []string{"", "Sat", "Sat 02:00", "Sat 02:00-02:00", "Funday 02:00-03:00", "Sat 25:00-26:00", "Sat 2-3", "Mon-Tue-Wed 02:00-03:00"} {
+		if _, err := ParseMaintenanceWindow(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestMaintenancePolicy(t *testing.T) {
+	location, err := time.LoadLocation("UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := Configuration{
+		DockerMaintenanceWindows:  []string{"Sat 02:00-06:00", "Mon 23:00-01:00"},
+		DockerMaintenanceTimezone: "UTC",
+	}
+	policy, err := GetMaintenancePolicy(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2015-06-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2015, 6, day, hour, minute, 0, 0, location)
+	}
+	tests := []struct {
+		t    time.Time
+		open bool
+	}{
+		{at(6, 2, 0), true},
+		{at(6, 5, 59), true},
+		{at(6, 6, 0), false},
+		{at(1, 23, 30), true},
+		{at(2, 0, 30), true},
+		{at(2, 1, 0), false},
+		{at(1, 0, 30), false},
+		{at(3, 12, 0), false},
+	}
+	for _, test := range tests {
+		if open := policy.IsOpen(test.t); open != test.open {
+			t.Errorf("%s: expected open=%v", test.t, test.open)
+		}
+	}
+
+	if next := policy.NextOpen(at(3, 12, 0)); !next.Equal(at(6, 2, 0)) {
+		t.Error("Expected the next window to open on Saturday, got", next)
+	}
+	if next := policy.NextOpen(at(6, 3, 0)); !next.Equal(at(6, 3, 0)) {
+		t.Error("Expected an open window to be returned as is, got", next)
+	}
+
+	if policy, err := GetMaintenancePolicy(Configuration{}); err != nil || !policy.IsOpen(at(3, 12, 0)) {
+		t.Error("Expected no windows to always allow upgrades")
+	}
+	if _, err := GetMaintenancePolicy(Configuration{DockerMaintenanceTimezone: "Nowhere/Nothing"}); err == nil {
+		t.Error("Expected an invalid timezone to be rejected")
+	}
+}
+
+func TestDockerUpgradePendingReports(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	var reports []DockerUpgradeStatus
+	oldConf, oldReport := Conf, reportDockerUpgrade
+	reportDockerUpgrade = func(status DockerUpgradeStatus) { reports = append(reports, status) }
+	defer func() {
+		Conf, reportDockerUpgrade = oldConf, oldReport
+		pendingUpgrade, pendingUpgradeWindow = false, time.Time{}
+	}()
+
+	Conf = Configuration{
+		DockerMaintenanceWindows:  []string{"Sat 02:00-06:00"},
+		DockerMaintenanceTimezone: "UTC",
+	}
+	// 2015-06-01 is a Monday
+	monday := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	upgradeNow := path.Join(os.TempDir(), "tutum-test-missing-upgrade-now")
+
+	if dockerUpgradeAllowed(upgradeNow, monday) || dockerUpgradeAllowed(upgradeNow, monday.Add(time.Hour)) {
+		t.Fatal("Expected the upgrade to be held")
+	}
+	if len(reports) != 1 || !reports[0].Pending || reports[0].NextWindow != "2015-06-06T02:00:00Z" {
+		t.Fatalf("Expected the held upgrade to be reported once, got %+v", reports)
+	}
+
+	Conf.DockerMaintenanceWindows = []string{"Wed 02:00-06:00"}
+	dockerUpgradeAllowed(upgradeNow, monday)
+	if len(reports) != 2 || reports[1].NextWindow != "2015-06-03T02:00:00Z" {
+		t.Fatalf("Expected the new window to be reported, got %+v", reports)
+	}
+
+	// the staged binary was removed while held
+	dockerUpgradeGone()
+	dockerUpgradeGone()
+	if len(reports) != 3 || reports[2].Pending {
+		t.Fatalf("Expected the upgrade to be reported as no longer pending once, got %+v", reports)
+	}
+}
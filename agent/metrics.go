@@ -0,0 +1,610 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeMetrics are the metrics of the host, from /proc. Network counters
+// are cumulative, in bytes, over all the interfaces but lo.
+type NodeMetrics struct {
+	CPUPercent  float64 `json:"cpu_percent"`
+	MemoryTotal uint64  `json:"memory_total"`
+	MemoryUsed  uint64  `json:"memory_used"`
+	Load1       float64 `json:"load1"`
+	NetRxBytes  uint64  `json:"net_rx_bytes"`
+	NetTxBytes  uint64  `json:"net_tx_bytes"`
+}
+
+// ContainerMetrics are the metrics of a container, from the docker stats
+// API. CPUPercent is relative to one CPU; network and block IO counters are
+// cumulative, in bytes.
+type ContainerMetrics struct {
+	ID              string  `json:"id"`
+	Name            string  `json:"name"`
+	CPUPercent      float64 `json:"cpu_percent"`
+	MemoryUsage     uint64  `json:"memory_usage"`
+	MemoryLimit     uint64  `json:"memory_limit"`
+	NetRxBytes      uint64  `json:"net_rx_bytes"`
+	NetTxBytes      uint64  `json:"net_tx_bytes"`
+	BlockReadBytes  uint64  `json:"block_read_bytes"`
+	BlockWriteBytes uint64  `json:"block_write_bytes"`
+}
+
+// MetricsSample is the state of the node and its containers at Time
+type MetricsSample struct {
+	Time       time.Time          `json:"time"`
+	Node       NodeMetrics        `json:"node"`
+	Containers []ContainerMetrics `json:"containers"`
+}
+
+// MetricsStore keeps the samples of the last Retention in memory
+type MetricsStore struct {
+	Retention time.Duration
+
+	mutex   sync.Mutex
+	samples []MetricsSample
+}
+
+func NewMetricsStore(retention time.Duration) *MetricsStore {
+	return &MetricsStore{Retention: retention}
+}
+
+// Add stores sample, and forgets the samples older than Retention
+func (s *MetricsStore) Add(sample MetricsSample) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples = append(s.samples, sample)
+	oldest := sample.Time.Add(-s.Retention)
+	i := 0
+	for i < len(s.samples) && s.samples[i].Time.Before(oldest) {
+		i++
+	}
+	s.samples = append([]MetricsSample{}, s.samples[i:]...)
+}
+
+// Query returns the samples taken since from, oldest first, only with the
+// metrics of the container with the given id or name if not empty
+func (s *MetricsStore) Query(from time.Time, container string) []MetricsSample {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var samples []MetricsSample
+	for _, sample := range s.samples {
+		if sample.Time.Before(from) {
+			continue
+		}
+		if container != "" {
+			var containers []ContainerMetrics
+			for _, c := range sample.Containers {
+				if c.ID == container || c.Name == container {
+					containers = append(containers, c)
+				}
+			}
+			sample.Containers = containers
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// Save writes the samples to file, for "tutum-agent metrics"
+func (s *MetricsStore) Save(file string) error {
+	s.mutex.Lock()
+	data, err := json.Marshal(s.samples)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Load replaces the samples with the ones saved in file
+func (s *MetricsStore) Load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var samples []MetricsSample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples = samples
+	return nil
+}
+
+// Metrics holds the samples of the last hour
+var Metrics = NewMetricsStore(MetricsRetention * time.Second)
+
+// MetricsCommand handles "tutum-agent metrics [container]", printing the
+// samples saved by the running agent, and exits
+func MetricsCommand(metricsFilePath string) {
+	if flag.NArg() == 0 || flag.Arg(0) != "metrics" {
+		return
+	}
+	if flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	store := NewMetricsStore(MetricsRetention * time.Second)
+	if err := store.Load(metricsFilePath); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot read the metrics collected by tutum-agent:", err)
+		os.Exit(1)
+	}
+	data, err := json.MarshalIndent(store.Query(time.Time{}, flag.Arg(1)), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(data))
+	os.Exit(0)
+}
+
+// MetricsStat is the minimum, average and maximum of a metric over a window
+type MetricsStat struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// add accounts for the n-th value v of the window
+func (s *MetricsStat) add(v float64, n int) {
+	if n == 1 || v < s.Min {
+		s.Min = v
+	}
+	if n == 1 || v > s.Max {
+		s.Max = v
+	}
+	s.Avg += (v - s.Avg) / float64(n)
+}
+
+// NodeMetricsSummary summarizes the node metrics over a window. Memory
+// total and network counters are the last ones of the window.
+type NodeMetricsSummary struct {
+	CPUPercent  MetricsStat `json:"cpu_percent"`
+	MemoryUsed  MetricsStat `json:"memory_used"`
+	Load1       MetricsStat `json:"load1"`
+	MemoryTotal uint64      `json:"memory_total"`
+	NetRxBytes  uint64      `json:"net_rx_bytes"`
+	NetTxBytes  uint64      `json:"net_tx_bytes"`
+}
+
+// ContainerMetricsSummary summarizes the metrics of a container over the
+// samples of the window in which it was running. Memory limit, network and
+// block IO counters are the last ones of the window.
+type ContainerMetricsSummary struct {
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Samples         int         `json:"samples"`
+	CPUPercent      MetricsStat `json:"cpu_percent"`
+	MemoryUsage     MetricsStat `json:"memory_usage"`
+	MemoryLimit     uint64      `json:"memory_limit"`
+	NetRxBytes      uint64      `json:"net_rx_bytes"`
+	NetTxBytes      uint64      `json:"net_tx_bytes"`
+	BlockReadBytes  uint64      `json:"block_read_bytes"`
+	BlockWriteBytes uint64      `json:"block_write_bytes"`
+}
+
+// MetricsSummary is what is sent to Tutum for the samples taken between
+// From and To
+type MetricsSummary struct {
+	From       time.Time                 `json:"from"`
+	To         time.Time                 `json:"to"`
+	Samples    int                       `json:"samples"`
+	Node       NodeMetricsSummary        `json:"node"`
+	Containers []ContainerMetricsSummary `json:"containers"`
+}
+
+// SummarizeMetrics returns the summary of samples, oldest first
+func SummarizeMetrics(samples []MetricsSample) MetricsSummary {
+	var summary MetricsSummary
+	containers := map[string]int{}
+	for i, sample := range samples {
+		n := i + 1
+		if n == 1 {
+			summary.From = sample.Time
+		}
+		summary.To = sample.Time
+		summary.Samples = n
+
+		node := &summary.Node
+		node.CPUPercent.add(sample.Node.CPUPercent, n)
+		node.MemoryUsed.add(float64(sample.Node.MemoryUsed), n)
+		node.Load1.add(sample.Node.Load1, n)
+		node.MemoryTotal = sample.Node.MemoryTotal
+		node.NetRxBytes, node.NetTxBytes = sample.Node.NetRxBytes, sample.Node.NetTxBytes
+
+		for _, c := range sample.Containers {
+			j, ok := containers[c.ID]
+			if !ok {
+				j = len(summary.Containers)
+				containers[c.ID] = j
+				summary.Containers = append(summary.Containers, ContainerMetricsSummary{ID: c.ID})
+			}
+			container := &summary.Containers[j]
+			container.Samples++
+			container.Name = c.Name
+			container.CPUPercent.add(c.CPUPercent, container.Samples)
+			container.MemoryUsage.add(float64(c.MemoryUsage), container.Samples)
+			container.MemoryLimit = c.MemoryLimit
+			container.NetRxBytes, container.NetTxBytes = c.NetRxBytes, c.NetTxBytes
+			container.BlockReadBytes, container.BlockWriteBytes = c.BlockReadBytes, c.BlockWriteBytes
+		}
+	}
+	return summary
+}
+
+type cpuCounter struct {
+	usage uint64
+	total uint64
+}
+
+// percent returns the usage between prev and c, in percent of the total
+func (c cpuCounter) percent(prev cpuCounter) float64 {
+	if prev.total == 0 || c.total <= prev.total || c.usage < prev.usage {
+		return 0
+	}
+	return float64(c.usage-prev.usage) / float64(c.total-prev.total) * 100
+}
+
+// MetricsCollector samples the node and container metrics every Interval,
+// stores them, and pushes a summary of them to Tutum every PushInterval
+type MetricsCollector struct {
+	Interval     time.Duration
+	PushInterval time.Duration
+	Store        *MetricsStore
+
+	procDir    string
+	file       string
+	nodeCPU    cpuCounter
+	containers map[string]cpuCounter
+	window     []MetricsSample
+	push       func(summary MetricsSummary) error
+}
+
+// NewMetricsCollector returns a collector saving the samples to file, and
+// loads the samples saved before the agent restarted
+func NewMetricsCollector(file string) *MetricsCollector {
+	c := &MetricsCollector{
+		Interval:     MetricsCollectInterval * time.Second,
+		PushInterval: MetricsPushInterval * time.Second,
+		Store:        Metrics,
+		procDir:      procDir,
+		file:         file,
+		containers:   map[string]cpuCounter{},
+		push: func(summary MetricsSummary) error {
+			return postNode(MetricsEndpoint, summary)
+		},
+	}
+	if Conf.MetricsCollectInterval > 0 {
+		c.Interval = time.Duration(Conf.MetricsCollectInterval) * time.Second
+	}
+	if Conf.MetricsPushInterval > 0 {
+		c.PushInterval = time.Duration(Conf.MetricsPushInterval) * time.Second
+	}
+	if *FlagStandalone {
+		c.push = nil
+	}
+	if err := c.Store.Load(file); err != nil && !os.IsNotExist(err) {
+		Logger.Println("Cannot load the saved metrics:", err)
+	}
+	return c
+}
+
+// Run collects the metrics every Interval, and pushes their summary every
+// PushInterval, forever
+func (c *MetricsCollector) Run() {
+	pushed := time.Now()
+	for {
+		time.Sleep(c.Interval)
+		now := time.Now()
+		c.Collect(now)
+		if c.push == nil || now.Sub(pushed) < c.PushInterval {
+			continue
+		}
+		pushed = now
+		if err := c.Flush(); err != nil {
+			Logger.Println("Cannot send metrics to Tutum:", err)
+		}
+	}
+}
+
+// Flush pushes the summary of the samples collected since the last flush.
+// They are dropped even if the push fails; the samples of the last hour
+// remain available in the store.
+func (c *MetricsCollector) Flush() error {
+	if len(c.window) == 0 {
+		return nil
+	}
+	summary := SummarizeMetrics(c.window)
+	c.window = nil
+	return c.push(summary)
+}
+
+// Collect takes a sample of the metrics and stores it. Metrics which cannot
+// be read are left empty.
+func (c *MetricsCollector) Collect(now time.Time) MetricsSample {
+	sample := MetricsSample{Time: now}
+	node, cpu, err := readNodeMetrics(c.procDir)
+	if err != nil {
+		Logger.Println("Cannot read node metrics:", err)
+	} else {
+		node.CPUPercent = cpu.percent(c.nodeCPU)
+		c.nodeCPU = cpu
+		sample.Node = node
+	}
+
+	oneShot := false
+	if v, err := getDockerDaemonVersion(DialTimeOut * time.Second); err == nil {
+		oneShot = GetDockerCapabilities(v).Supports(CapStatsOneShot)
+	}
+	containers, err := readContainerMetrics(DialTimeOut*time.Second, oneShot)
+	if err != nil && *FlagDebugMode {
+		Logger.Println("Cannot read container metrics:", err)
+	}
+	seen := map[string]cpuCounter{}
+	for _, container := range containers {
+		cpu := container.cpu
+		container.CPUPercent = cpu.percent(c.containers[container.ID])
+		seen[container.ID] = cpu
+		sample.Containers = append(sample.Containers, container.ContainerMetrics)
+	}
+	c.containers = seen
+
+	c.Store.Add(sample)
+	if c.file != "" {
+		if err := c.Store.Save(c.file); err != nil {
+			Logger.Println("Cannot save metrics:", err)
+		}
+	}
+	if c.push != nil {
+		c.window = append(c.window, sample)
+	}
+	return sample
+}
+
+// readNodeMetrics reads the node metrics, and the cpu counters from which
+// the CPU usage is computed, in jiffies
+func readNodeMetrics(procDir string) (NodeMetrics, cpuCounter, error) {
+	var node NodeMetrics
+	var cpu cpuCounter
+
+	stat, err := ioutil.ReadFile(path.Join(procDir, "stat"))
+	if err != nil {
+		return node, cpu, err
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var idle uint64
+		for i, field := range fields[1:] {
+			n, _ := strconv.ParseUint(field, 10, 64)
+			cpu.total += n
+			// idle and iowait
+			if i == 3 || i == 4 {
+				idle += n
+			}
+		}
+		cpu.usage = cpu.total - idle
+	}
+
+	meminfo, err := readMeminfo(path.Join(procDir, "meminfo"))
+	if err != nil {
+		return node, cpu, err
+	}
+	node.MemoryTotal = meminfo["MemTotal"]
+	available, ok := meminfo["MemAvailable"]
+	if !ok {
+		available = meminfo["MemFree"] + meminfo["Buffers"] + meminfo["Cached"]
+	}
+	if available < node.MemoryTotal {
+		node.MemoryUsed = node.MemoryTotal - available
+	}
+
+	if loadavg, err := ioutil.ReadFile(path.Join(procDir, "loadavg")); err == nil {
+		if fields := strings.Fields(string(loadavg)); len(fields) > 0 {
+			node.Load1, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	if netdev, err := ioutil.ReadFile(path.Join(procDir, "net", "dev")); err == nil {
+		for _, line := range strings.Split(string(netdev), "\n") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+				continue
+			}
+			fields := strings.Fields(parts[1])
+			if len(fields) < 9 {
+				continue
+			}
+			rx, _ := strconv.ParseUint(fields[0], 10, 64)
+			tx, _ := strconv.ParseUint(fields[8], 10, 64)
+			node.NetRxBytes += rx
+			node.NetTxBytes += tx
+		}
+	}
+	return node, cpu, nil
+}
+
+// readMeminfo returns the fields of /proc/meminfo, in bytes
+func readMeminfo(file string) (map[string]uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meminfo := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			n *= 1024
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = n
+	}
+	if _, ok := meminfo["MemTotal"]; !ok {
+		return nil, errors.New("no MemTotal in " + file)
+	}
+	return meminfo, nil
+}
+
+type containerSample struct {
+	ContainerMetrics
+	cpu cpuCounter
+}
+
+type dockerNetworkStats struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// dockerStats is the part of the docker stats API used by the agent.
+// Network stats are per interface since docker 1.9.
+type dockerStats struct {
+	Read     time.Time `json:"read"`
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64 `json:"usage"`
+		Limit uint64 `json:"limit"`
+	} `json:"memory_stats"`
+	Network    *dockerNetworkStats           `json:"network"`
+	Networks   map[string]dockerNetworkStats `json:"networks"`
+	BlkioStats struct {
+		IOServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+// readContainerMetrics reads the stats of the running containers, up to
+// MetricsStatsConcurrency at once. The CPU counters are in nanoseconds of CPU
+// time and of wall time.
+func readContainerMetrics(timeout time.Duration, oneShot bool) ([]containerSample, error) {
+	body, err := dockerAPIGet("/containers/json", timeout)
+	if err != nil {
+		return nil, err
+	}
+	var containers []struct {
+		Id    string
+		Names []string
+	}
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return nil, err
+	}
+
+	results := make([]*containerSample, len(containers))
+	sem := make(chan struct{}, MetricsStatsConcurrency)
+	var wg sync.WaitGroup
+	for i, container := range containers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string, names []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			stats, err := readContainerStats(id, timeout, oneShot)
+			if err != nil {
+				return
+			}
+			sample := newContainerSample(id, names, stats)
+			results[i] = &sample
+		}(i, container.Id, container.Names)
+	}
+	wg.Wait()
+
+	var samples []containerSample
+	for _, sample := range results {
+		if sample != nil {
+			samples = append(samples, *sample)
+		}
+	}
+	return samples, nil
+}
+
+func newContainerSample(id string, names []string, stats *dockerStats) containerSample {
+	sample := containerSample{ContainerMetrics: ContainerMetrics{
+		ID:          id,
+		Name:        id,
+		MemoryUsage: stats.MemoryStats.Usage,
+		MemoryLimit: stats.MemoryStats.Limit,
+	}}
+	if len(names) > 0 {
+		sample.Name = strings.TrimPrefix(names[0], "/")
+	}
+	if stats.Network != nil {
+		sample.NetRxBytes, sample.NetTxBytes = stats.Network.RxBytes, stats.Network.TxBytes
+	}
+	for _, network := range stats.Networks {
+		sample.NetRxBytes += network.RxBytes
+		sample.NetTxBytes += network.TxBytes
+	}
+	for _, entry := range stats.BlkioStats.IOServiceBytesRecursive {
+		switch entry.Op {
+		case "Read":
+			sample.BlockReadBytes += entry.Value
+		case "Write":
+			sample.BlockWriteBytes += entry.Value
+		}
+	}
+	sample.cpu = cpuCounter{usage: stats.CPUStats.CPUUsage.TotalUsage, total: uint64(stats.Read.UnixNano())}
+	return sample
+}
+
+// readContainerStats reads the stats of a container, with stream=false if
+// oneShot is set, as it is only supported since docker 1.7, or else reads
+// the first stats of the stream
+func readContainerStats(id string, timeout time.Duration, oneShot bool) (*dockerStats, error) {
+	var stats dockerStats
+	if oneShot {
+		body, err := dockerAPIGet("/containers/"+id+"/stats?stream=false", timeout)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &stats); err != nil {
+			return nil, err
+		}
+		return &stats, nil
+	}
+
+	body, err := dockerAPIStream("/containers/" + id + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	timer := time.AfterFunc(timeout, func() { body.Close() })
+	defer timer.Stop()
+	if err := json.NewDecoder(body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeProcFiles(t *testing.T, dir string, user, idle int) {
+	files := map[string]string{
+		"stat":    fmt.Sprintf("cpu  %d 0 0 %d 0 0 0 0 0 0\ncpu0 %d 0 0 %d 0 0 0 0 0 0\n", user, idle, user, idle),
+		"meminfo": "MemTotal:        2048 kB\nMemFree:          512 kB\nMemAvailable:    1024 kB\n",
+		"loadavg": "0.50 0.40 0.30 1/100 1234\n",
+		"net/dev": "Inter-|   Receive                                                |  Transmit\n" +
+			" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+			"    lo:     100       1    0    0    0     0          0         0      100       1    0    0    0     0       0          0\n" +
+			"  eth0:    1000      10    0    0    0     0          0         0     2000      20    0    0    0     0       0          0\n",
+	}
+	for name, content := range files {
+		os.MkdirAll(path.Dir(path.Join(dir, name)), 0755)
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	debug := false
+	oldDebug := FlagDebugMode
+	FlagDebugMode = &debug
+	defer func() { FlagDebugMode = oldDebug }()
+
+	dir, err := ioutil.TempDir("", "metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var usage int64
+	read := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Id":"aaa","Names":["/web"]}]`)
+	})
+	mux.HandleFunc("/containers/aaa/stats", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"read":%q,"cpu_stats":{"cpu_usage":{"total_usage":%d}},`+
+			`"memory_stats":{"usage":100,"limit":1000},"networks":{"eth0":{"rx_bytes":10,"tx_bytes":20},"eth1":{"rx_bytes":1,"tx_bytes":2}},`+
+			`"blkio_stats":{"io_service_bytes_recursive":[{"op":"Read","value":5},{"op":"Write","value":7},{"op":"Total","value":12}]}}`,
+			read.Format(time.RFC3339Nano), usage)
+	})
+	defer serveFakeDocker(t, mux)()
+
+	c := &MetricsCollector{Store: NewMetricsStore(time.Hour), procDir: dir, containers: map[string]cpuCounter{}}
+	start := time.Now()
+
+	writeProcFiles(t, dir, 100, 300)
+	c.Collect(start)
+
+	// a second later, the node used 1 of 4 jiffies and the container half a CPU
+	writeProcFiles(t, dir, 200, 600)
+	usage = int64(500 * time.Millisecond)
+	read = read.Add(time.Second)
+	sample := c.Collect(start.Add(time.Minute))
+
+	node := sample.Node
+	if node.CPUPercent != 25 || node.MemoryTotal != 2048*1024 || node.MemoryUsed != 1024*1024 || node.Load1 != 0.5 ||
+		node.NetRxBytes != 1000 || node.NetTxBytes != 2000 {
+		t.Fatalf("Unexpected node metrics %+v", node)
+	}
+	if len(sample.Containers) != 1 {
+		t.Fatal("Expected the metrics of one container, got", sample.Containers)
+	}
+	container := sample.Containers[0]
+	if container.Name != "web" || container.CPUPercent != 50 || container.MemoryUsage != 100 || container.MemoryLimit != 1000 ||
+		container.NetRxBytes != 11 || container.NetTxBytes != 22 || container.BlockReadBytes != 5 || container.BlockWriteBytes != 7 {
+		t.Fatalf("Unexpected container metrics %+v", container)
+	}
+
+	if samples := c.Store.Query(start.Add(time.Second), "web"); len(samples) != 1 || len(samples[0].Containers) != 1 {
+		t.Fatal("Expected the last sample of web, got", samples)
+	}
+	if samples := c.Store.Query(start, "other"); len(samples) != 2 || len(samples[0].Containers) != 0 {
+		t.Fatal("Expected the samples without containers, got", samples)
+	}
+}
+
+func TestMetricsStoreRetention(t *testing.T) {
+	s := NewMetricsStore(time.Hour)
+	start := time.Now()
+	for i := 0; i <= 90; i += 10 {
+		s.Add(MetricsSample{Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	samples := s.Query(time.Time{}, "")
+	if len(samples) != 7 || !samples[0].Time.Equal(start.Add(30*time.Minute)) {
+		t.Fatal("Expected only the samples of the last hour, got", len(samples))
+	}
+}
+
+func TestMetricsCollectorPushesSummaries(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	debug := false
+	oldDebug := FlagDebugMode
+	FlagDebugMode = &debug
+	defer func() { FlagDebugMode = oldDebug }()
+
+	dir, err := ioutil.TempDir("", "metrics-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	memory := map[string]int{"aaa": 100, "bbb": 400}
+	var streamed []string
+	var mutex sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Version":"1.12.6"}`)
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"Id":"aaa","Names":["/web"]},{"Id":"bbb","Names":["/db"]}]`)
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")[0]
+		mutex.Lock()
+		streamed = append(streamed, r.URL.Query().Get("stream"))
+		usage := memory[id]
+		mutex.Unlock()
+		fmt.Fprintf(w, `{"read":"2015-06-01T00:00:00Z","memory_stats":{"usage":%d,"limit":1000}}`, usage)
+	})
+	defer serveFakeDocker(t, mux)()
+
+	var pushed []MetricsSummary
+	file := path.Join(dir, MetricsFileName)
+	c := &MetricsCollector{
+		Store:      NewMetricsStore(time.Hour),
+		procDir:    dir,
+		file:       file,
+		containers: map[string]cpuCounter{},
+		push: func(summary MetricsSummary) error {
+			pushed = append(pushed, summary)
+			return nil
+		},
+	}
+	start := time.Now()
+	writeProcFiles(t, dir, 100, 300)
+	c.Collect(start)
+	writeProcFiles(t, dir, 200, 600)
+	memory["aaa"] = 300
+	c.Collect(start.Add(time.Minute))
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range streamed {
+		if stream != "false" {
+			t.Fatal("Expected the stats to be read with stream=false, got", streamed)
+		}
+	}
+	if len(pushed) != 1 {
+		t.Fatal("Expected one summary, got", len(pushed))
+	}
+	summary := pushed[0]
+	if summary.Samples != 2 || !summary.From.Equal(start) || !summary.To.Equal(start.Add(time.Minute)) {
+		t.Fatalf("Unexpected summary window %+v", summary)
+	}
+	if cpu := summary.Node.CPUPercent; cpu.Min != 0 || cpu.Avg != 12.5 || cpu.Max != 25 {
+		t.Fatalf("Unexpected node CPU %+v", cpu)
+	}
+	if len(summary.Containers) != 2 || summary.Containers[0].Name != "web" || summary.Containers[1].Name != "db" {
+		t.Fatalf("Unexpected containers %+v", summary.Containers)
+	}
+	if memory := summary.Containers[0].MemoryUsage; memory.Min != 100 || memory.Avg != 200 || memory.Max != 300 {
+		t.Fatalf("Unexpected container memory %+v", memory)
+	}
+
+	// the window is emptied once pushed
+	if err := c.Flush(); err != nil || len(pushed) != 1 {
+		t.Fatal("Expected nothing to push")
+	}
+
+	// the samples are saved for "tutum-agent metrics"
+	store := NewMetricsStore(time.Hour)
+	if err := store.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if samples := store.Query(time.Time{}, "db"); len(samples) != 2 || len(samples[1].Containers) != 1 {
+		t.Fatal("Expected the saved samples of db, got", samples)
+	}
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"os"
+	"path"
+)
+
+// SetPaths relocates the directories and files used by the agent. Every
+// default location is prefixed with root, while a non-empty override is
+// used verbatim, so several agents can run side by side on one host.
+func SetPaths(root, tutumHome, dockerDir, logDir, pidFile, dockerSymlink string) {
+	TutumHome = resolvePath(root, tutumHome, defaultTutumHome)
+	DockerDir = resolvePath(root, dockerDir, defaultDockerDir)
+	LogDir = resolvePath(root, logDir, defaultLogDir)
+	TutumPidFile = resolvePath(root, pidFile, defaultTutumPidFile)
+	DockerSymbolicLink = resolvePath(root, dockerSymlink, defaultDockerSymbolicLink)
+	DockerDefaultHost = "unix://" + resolvePath(root, "", defaultDockerSocket)
+	DockerPidFile = resolvePath(root, "", defaultDockerPidFile)
+	DockerDataRoot = resolvePath(root, "", defaultDockerDataRoot)
+	DockerSystemdDropIn = resolvePath(root, "", defaultDockerSystemdDropIn)
+	DockerClientConfig = resolvePath(root, "", defaultDockerClientConfig)
+}
+
+func resolvePath(root, override, defaultPath string) string {
+	if override != "" {
+		return override
+	}
+	if root == "" {
+		return defaultPath
+	}
+	return path.Join(root, defaultPath)
+}
+
+// CreateDirs makes sure the directories the agent writes to exist
+func CreateDirs() {
+	dirs := []string{TutumHome, DockerDir, LogDir,
+		path.Dir(TutumPidFile), path.Dir(DockerSymbolicLink)}
+	for _, dir := range dirs {
+		_ = os.MkdirAll(dir, 0755)
+	}
+}
+
+// IsUnprivileged reports whether the agent runs without root privileges,
+// in which case it cannot raise process priorities
+func IsUnprivileged() bool {
+	return os.Geteuid() != 0
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestSetPaths(t *testing.T) {
+	defer SetPaths("", "", "", "", "", "")
+
+	SetPaths("", "", "", "", "", "")
+	if TutumHome != defaultTutumHome || DockerDir != defaultDockerDir || LogDir != defaultLogDir {
+		t.Fatal("Expected default paths without root and overrides")
+	}
+	if DockerDefaultHost != "unix:///var/run/docker.sock" {
+		t.Fatal("Unexpected docker default host:", DockerDefaultHost)
+	}
+
+	SetPaths("/tmp/agent1", "", "", "/tmp/logs", "", "")
+	if TutumHome != "/tmp/agent1/etc/tutum/agent" {
+		t.Fatal("Expected prefixed TutumHome, got", TutumHome)
+	}
+	if DockerDir != "/tmp/agent1/usr/lib/tutum" {
+		t.Fatal("Expected prefixed DockerDir, got", DockerDir)
+	}
+	if LogDir != "/tmp/logs" {
+		t.Fatal("Expected overridden LogDir, got", LogDir)
+	}
+	if TutumPidFile != "/tmp/agent1/var/run/tutum-agent.pid" {
+		t.Fatal("Expected prefixed TutumPidFile, got", TutumPidFile)
+	}
+	if DockerSymbolicLink != "/tmp/agent1/usr/bin/docker" {
+		t.Fatal("Expected prefixed DockerSymbolicLink, got", DockerSymbolicLink)
+	}
+	if DockerDefaultHost != "unix:///tmp/agent1/var/run/docker.sock" {
+		t.Fatal("Expected prefixed DockerDefaultHost, got", DockerDefaultHost)
+	}
+	if DockerDataRoot != "/tmp/agent1/var/lib/docker" || dockerDataRoot() != DockerDataRoot {
+		t.Fatal("Expected prefixed DockerDataRoot, got", DockerDataRoot)
+	}
+}
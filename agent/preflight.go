@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/blang/semver"
+)
+
+// Statuses of a preflight check
+const (
+	PreflightOK      = "ok"
+	PreflightWarning = "warning"
+	PreflightFailure = "failure"
+)
+
+// filesystem magic numbers, from statfs(2)
+const (
+	btrfsSuperMagic = 0x9123683E
+	zfsSuperMagic   = 0x2FC12FC2
+)
+
+var (
+	minKernelVersion         = mustVersion("3.10.0")
+	minOverlay2KernelVersion = mustVersion("4.0.0")
+
+	cgroupV1Controllers = []string{"cpu", "cpuacct", "memory", "devices", "freezer", "blkio"}
+	cgroupV2Controllers = []string{"cpu", "memory", "pids", "io"}
+
+	// filesystems required by the storage drivers, as listed in /proc/filesystems
+	storageDriverFilesystems = map[string]string{
+		"aufs":     "aufs",
+		"overlay":  "overlay",
+		"overlay2": "overlay",
+		"btrfs":    "btrfs",
+		"zfs":      "zfs",
+	}
+)
+
+// PreflightResult is the outcome of a host check run before docker starts
+type PreflightResult struct {
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+func (r PreflightResult) String() string {
+	return fmt.Sprintf("[%s] %s: %s", r.Status, r.Check, r.Message)
+}
+
+func preflightOK(check, format string, args ...interface{}) PreflightResult {
+	return PreflightResult{check, PreflightOK, fmt.Sprintf(format, args...)}
+}
+
+func preflightWarning(check, format string, args ...interface{}) PreflightResult {
+	return PreflightResult{check, PreflightWarning, fmt.Sprintf(format, args...)}
+}
+
+func preflightFailure(check, format string, args ...interface{}) PreflightResult {
+	return PreflightResult{check, PreflightFailure, fmt.Sprintf(format, args...)}
+}
+
+// PreflightChecks checks that the host can run docker with the current
+// configuration. The port check is skipped when checkPort is not set, as
+// the port is held by docker while the agent runs.
+func PreflightChecks(checkPort bool) []PreflightResult {
+	release := kernelRelease()
+	results := []PreflightResult{
+		checkKernel(release),
+		checkCgroups(path.Join(procDir, "cgroups"), CgroupRoot),
+		checkStorageDriver(Conf.DockerStorageDriver, release, path.Join(procDir, "filesystems"), path.Join(procDir, "devices"), dockerDataRoot()),
+		checkIptables(),
+		checkDiskSpace(dockerDataRoot(), PreflightMinFreeDisk*1024*1024),
+	}
+	if checkPort {
+		results = append(results, checkDockerHostPort(Conf.DockerHost))
+	}
+	return results
+}
+
+// PreflightFailed reports whether any check failed
+func PreflightFailed(results []PreflightResult) bool {
+	for _, result := range results {
+		if result.Status == PreflightFailure {
+			return true
+		}
+	}
+	return false
+}
+
+// RunPreflight runs the checks before docker is started, and again after
+// it crashed, logging and reporting the problems found. Docker is started
+// anyway, as some checks cannot be fully reliable.
+func RunPreflight() []PreflightResult {
+	Logger.Println("Running preflight checks")
+	results := PreflightChecks(true)
+	var problems []PreflightResult
+	for _, result := range results {
+		if result.Status != PreflightOK {
+			Logger.Println("Preflight:", result)
+			problems = append(problems, result)
+		}
+	}
+	if len(problems) == 0 {
+		Logger.Println("Preflight checks passed")
+		return results
+	}
+	if PreflightFailed(problems) {
+		SendError(errors.New("preflight checks failed"), "Preflight checks failed", map[string]interface{}{"preflight": problems})
+	}
+	ReportPreflight(problems)
+	return results
+}
+
+// PreflightCommand handles "tutum-agent preflight", printing the result of
+// the checks and exiting with 1 if any failed
+func PreflightCommand(configFilePath string) {
+	if flag.NArg() == 0 || flag.Arg(0) != "preflight" {
+		return
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if conf, err := LoadConf(configFilePath); err == nil {
+		Conf = *conf
+	} else {
+		LoadDefaultConf()
+	}
+	agentRunning := isAgentRunning(TutumPidFile)
+	results := PreflightChecks(!agentRunning)
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if agentRunning {
+		fmt.Println("tutum-agent is running, skipped the docker port check")
+	}
+	if PreflightFailed(results) {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func kernelRelease() string {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return ""
+	}
+	var buf []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		buf = append(buf, byte(c))
+	}
+	return string(buf)
+}
+
+var kernelVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseKernelVersion parses releases such as 3.13.0-24-generic or 4.1
+func parseKernelVersion(release string) (semver.Version, error) {
+	match := kernelVersionRegexp.FindStringSubmatch(release)
+	if match == nil {
+		return semver.Version{}, fmt.Errorf("cannot parse kernel release %q", release)
+	}
+	var v semver.Version
+	v.Major, _ = strconv.ParseUint(match[1], 10, 64)
+	v.Minor, _ = strconv.ParseUint(match[2], 10, 64)
+	if match[3] != "" {
+		v.Patch, _ = strconv.ParseUint(match[3], 10, 64)
+	}
+	return v, nil
+}
+
+func checkKernel(release string) PreflightResult {
+	v, err := parseKernelVersion(release)
+	if err != nil {
+		return preflightWarning("kernel", "%s", err)
+	}
+	if v.LT(minKernelVersion) {
+		return preflightFailure("kernel", "kernel %s is older than %s", release, minKernelVersion)
+	}
+	return preflightOK("kernel", "kernel %s", release)
+}
+
+// checkCgroups checks the controllers required by docker, in cgroup.controllers
+// on the unified hierarchy and in /proc/cgroups otherwise
+func checkCgroups(procCgroups, cgroupRoot string) PreflightResult {
+	enabled := map[string]bool{}
+	required := cgroupV1Controllers
+	if data, err := ioutil.ReadFile(path.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		required = cgroupV2Controllers
+		for _, controller := range strings.Fields(string(data)) {
+			enabled[controller] = true
+		}
+	} else {
+		data, err := ioutil.ReadFile(procCgroups)
+		if err != nil {
+			return preflightFailure("cgroups", "cannot read %s: %s", procCgroups, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 4 && !strings.HasPrefix(fields[0], "#") && fields[3] == "1" {
+				enabled[fields[0]] = true
+			}
+		}
+	}
+	var missing []string
+	for _, controller := range required {
+		if !enabled[controller] {
+			missing = append(missing, controller)
+		}
+	}
+	if len(missing) > 0 {
+		return preflightFailure("cgroups", "missing cgroup controllers: %s", strings.Join(missing, ", "))
+	}
+	return preflightOK("cgroups", "controllers %s enabled", strings.Join(required, ", "))
+}
+
+// checkStorageDriver checks the prerequisites of the configured storage
+// driver. Filesystems not listed yet only raise a warning, as their module
+// may be loaded when docker mounts them.
+func checkStorageDriver(driver, release, procFilesystems, procDevices, dataRoot string) PreflightResult {
+	if driver == "" {
+		return preflightOK("storage-driver", "no storage driver configured, docker picks one")
+	}
+	if driver == "overlay2" {
+		if v, err := parseKernelVersion(release); err == nil && v.LT(minOverlay2KernelVersion) {
+			return preflightFailure("storage-driver", "overlay2 requires kernel %s or later, found %s", minOverlay2KernelVersion, release)
+		}
+	}
+	if driver == "devicemapper" {
+		data, err := ioutil.ReadFile(procDevices)
+		if err != nil || !strings.Contains(string(data), "device-mapper") {
+			return preflightWarning("storage-driver", "device-mapper is not loaded (modprobe dm_mod)")
+		}
+		return preflightOK("storage-driver", "devicemapper is supported")
+	}
+	fs, ok := storageDriverFilesystems[driver]
+	if !ok {
+		return preflightWarning("storage-driver", "unknown storage driver %s", driver)
+	}
+	data, err := ioutil.ReadFile(procFilesystems)
+	if err != nil {
+		return preflightWarning("storage-driver", "cannot read %s: %s", procFilesystems, err)
+	}
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fs {
+			found = true
+		}
+	}
+	if !found {
+		return preflightWarning("storage-driver", "filesystem %s is not loaded (modprobe %s)", fs, fs)
+	}
+	if magic, ok := map[string]int64{"btrfs": btrfsSuperMagic, "zfs": zfsSuperMagic}[driver]; ok {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(existingParent(dataRoot), &stat); err == nil && int64(stat.Type) != magic {
+			return preflightFailure("storage-driver", "%s requires %s to be on a %s filesystem", driver, dataRoot, fs)
+		}
+	}
+	return preflightOK("storage-driver", "%s is supported", driver)
+}
+
+func checkIptables() PreflightResult {
+	if strings.Contains(Conf.DockerOpts, "--iptables=false") {
+		return preflightOK("iptables", "disabled in DockerOpts")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return preflightFailure("iptables", "iptables not found in PATH")
+	}
+	return preflightOK("iptables", "iptables found")
+}
+
+// checkDiskSpace checks the free space of the filesystem holding dataRoot
+func checkDiskSpace(dataRoot string, minFree uint64) PreflightResult {
+	var stat syscall.Statfs_t
+	dir := existingParent(dataRoot)
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return preflightWarning("disk-space", "cannot stat %s: %s", dir, err)
+	}
+	free := stat.Bavail * uint64(stat.Bsize)
+	if free < minFree {
+		return preflightFailure("disk-space", "%d MB free under %s, at least %d MB required", free/1024/1024, dataRoot, minFree/1024/1024)
+	}
+	return preflightOK("disk-space", "%d MB free under %s", free/1024/1024, dataRoot)
+}
+
+// checkDockerHostPort checks that nothing already listens on DockerHost
+func checkDockerHostPort(dockerHost string) PreflightResult {
+	u, err := url.Parse(dockerHost)
+	if err != nil || u.Scheme != "tcp" {
+		return preflightOK("port", "docker does not listen on tcp")
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return preflightFailure("port", "cannot listen on %s: %s", u.Host, err)
+	}
+	l.Close()
+	return preflightOK("port", "%s is available", u.Host)
+}
+
+func dockerDataRoot() string {
+	if Conf.DockerGraph != "" {
+		return Conf.DockerGraph
+	}
+	return DockerDataRoot
+}
+
+// existingParent returns dir, or its closest existing parent
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" || dir == "." {
+			return dir
+		}
+		dir = path.Dir(dir)
+	}
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		release  string
+		expected string
+	}{
+		{"3.13.0-24-generic", "3.13.0"},
+		{"4.1", "4.1.0"},
+		{"2.6.32-573.el6.x86_64", "2.6.32"},
+		{"5.10.0-8-amd64", "5.10.0"},
+	}
+	for _, test := range tests {
+		v, err := parseKernelVersion(test.release)
+		if err != nil || v.String() != test.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", test.release, test.expected, v, err)
+		}
+	}
+	if _, err := parseKernelVersion("unknown"); err == nil {
+		t.Error("Expected an error for an invalid release")
+	}
+
+	if result := checkKernel("2.6.32-573.el6.x86_64"); result.Status != PreflightFailure {
+		t.Error("Expected old kernels to fail:", result)
+	}
+	if result := checkKernel("3.10.0-327.el7.x86_64"); result.Status != PreflightOK {
+		t.Error("Expected 3.10 kernels to pass:", result)
+	}
+}
+
+func TestCheckCgroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	procCgroups := path.Join(dir, "cgroups")
+	content := "#subsys_name\thierarchy\tnum_cgroups\tenabled\n" +
+		"cpuset\t2\t1\t1\ncpu\t3\t60\t1\ncpuacct\t3\t60\t1\nblkio\t4\t60\t1\n" +
+		"memory\t5\t60\t0\ndevices\t6\t60\t1\nfreezer\t7\t1\t1\n"
+	if err := ioutil.WriteFile(procCgroups, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := checkCgroups(procCgroups, dir)
+	if result.Status != PreflightFailure || result.Message != "missing cgroup controllers: memory" {
+		t.Fatal("Expected the disabled memory controller to be reported:", result)
+	}
+
+	// cgroup v2
+	if err := ioutil.WriteFile(path.Join(dir, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result := checkCgroups(procCgroups, dir); result.Status != PreflightOK {
+		t.Fatal("Expected cgroup v2 controllers to pass:", result)
+	}
+}
+
+func TestCheckStorageDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filesystems := path.Join(dir, "filesystems")
+	devices := path.Join(dir, "devices")
+	if err := ioutil.WriteFile(filesystems, []byte("nodev\tsysfs\n\text4\nnodev\toverlay\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(devices, []byte("Block devices:\n  8 sd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		driver   string
+		release  string
+		expected string
+	}{
+		{"", "4.4.0", PreflightOK},
+		{"overlay", "3.18.0", PreflightOK},
+		{"overlay2", "4.4.0", PreflightOK},
+		{"overlay2", "3.19.0", PreflightFailure},
+		{"aufs", "4.4.0", PreflightWarning},
+		{"devicemapper", "4.4.0", PreflightWarning},
+		{"unknown", "4.4.0", PreflightWarning},
+	}
+	for _, test := range tests {
+		result := checkStorageDriver(test.driver, test.release, filesystems, devices, dir)
+		if result.Status != test.expected {
+			t.Errorf("%s on %s: expected %s, got %s", test.driver, test.release, test.expected, result)
+		}
+	}
+}
+
+func TestCheckDockerHostPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if result := checkDockerHostPort("tcp://" + l.Addr().String()); result.Status != PreflightFailure {
+		t.Fatal("Expected a port conflict:", result)
+	}
+	if result := checkDockerHostPort("unix:///var/run/docker.sock"); result.Status != PreflightOK {
+		t.Fatal("Expected unix sockets to be skipped:", result)
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	missing := path.Join(dir, "not", "created")
+	if result := checkDiskSpace(missing, 0); result.Status != PreflightOK {
+		t.Fatal("Expected the closest existing parent to be checked:", result)
+	}
+	if result := checkDiskSpace(missing, 1<<62); result.Status != PreflightFailure {
+		t.Fatal("Expected a failure without enough disk space:", result)
+	}
+}
@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const procDir = "/proc"
+
+// ProcessInfo is the information read from /proc/<pid>/stat
+type ProcessInfo struct {
+	Pid  int
+	PPid int
+	Comm string
+	Nice int
+}
+
+// ProcessTree is a process with all its descendants
+type ProcessTree struct {
+	ProcessInfo
+	Children []*ProcessTree
+}
+
+// ProcessPolicy sets the niceness and the oom_score_adj of the docker daemon
+// and of its descendants (containers). Nil values are left untouched.
+type ProcessPolicy struct {
+	DockerNice           *int
+	ContainerNice        *int
+	DockerOOMScoreAdj    *int
+	ContainerOOMScoreAdj *int
+}
+
+// parseProcStat parses the content of /proc/<pid>/stat. The command name is
+// enclosed in parentheses and may itself contain spaces and parentheses.
+func parseProcStat(data []byte) (ProcessInfo, error) {
+	var info ProcessInfo
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndex(data, []byte(")"))
+	if start < 0 || end < start {
+		return info, errors.New("malformed stat content")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data[:start])))
+	if err != nil {
+		return info, err
+	}
+	info.Pid = pid
+	info.Comm = string(data[start+1 : end])
+
+	// fields after the command name start with the state (field 3)
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 17 {
+		return info, errors.New("malformed stat content")
+	}
+	if info.PPid, err = strconv.Atoi(fields[1]); err != nil {
+		return info, err
+	}
+	if info.Nice, err = strconv.Atoi(fields[16]); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// readProcesses lists all the processes found in dir, usually /proc
+func readProcesses(dir string) ([]ProcessInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var procs []ProcessInfo
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, entry.Name(), "stat"))
+		if err != nil {
+			// the process exited in the meantime
+			continue
+		}
+		info, err := parseProcStat(data)
+		if err != nil {
+			continue
+		}
+		procs = append(procs, info)
+	}
+	return procs, nil
+}
+
+// buildProcessTree returns the tree of processes rooted at rootPid
+func buildProcessTree(procs []ProcessInfo, rootPid int) (*ProcessTree, error) {
+	nodes := map[int]*ProcessTree{}
+	for _, info := range procs {
+		nodes[info.Pid] = &ProcessTree{ProcessInfo: info}
+	}
+	root, ok := nodes[rootPid]
+	if !ok {
+		return nil, fmt.Errorf("process %d not found", rootPid)
+	}
+	for _, info := range procs {
+		if info.Pid == rootPid {
+			continue
+		}
+		if parent, ok := nodes[info.PPid]; ok {
+			parent.Children = append(parent.Children, nodes[info.Pid])
+		}
+	}
+	for _, node := range nodes {
+		sort.Sort(byPid(node.Children))
+	}
+	return root, nil
+}
+
+type byPid []*ProcessTree
+
+func (p byPid) Len() int           { return len(p) }
+func (p byPid) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPid) Less(i, j int) bool { return p[i].Pid < p[j].Pid }
+
+// Descendants returns all the processes below t
+func (t *ProcessTree) Descendants() []*ProcessTree {
+	var descendants []*ProcessTree
+	for _, child := range t.Children {
+		descendants = append(descendants, child)
+		descendants = append(descendants, child.Descendants()...)
+	}
+	return descendants
+}
+
+func (t *ProcessTree) String() string {
+	var buf bytes.Buffer
+	t.write(&buf, 0)
+	return buf.String()
+}
+
+func (t *ProcessTree) write(buf *bytes.Buffer, depth int) {
+	fmt.Fprintf(buf, "%s%d %s (nice %d)\n", strings.Repeat("  ", depth), t.Pid, t.Comm, t.Nice)
+	for _, child := range t.Children {
+		child.write(buf, depth+1)
+	}
+}
+
+// DockerProcessTree returns the docker daemon with all its descendants
+func DockerProcessTree() (*ProcessTree, error) {
+	if Docker == nil || Docker.Pid() == 0 {
+		return nil, errors.New("docker daemon is not running")
+	}
+	procs, err := readProcesses(procDir)
+	if err != nil {
+		return nil, err
+	}
+	return buildProcessTree(procs, Docker.Pid())
+}
+
+// getProcessPolicy returns the policy from the configuration, with the
+// default of renicing docker but not its containers. The OOM killer score
+// of docker is left alone unless configured.
+func getProcessPolicy() ProcessPolicy {
+	dockerNice, containerNice := RenicePriority, 0
+	containerOOMScoreAdj := ContainerOOMScoreAdj
+	policy := ProcessPolicy{
+		DockerNice:           &dockerNice,
+		ContainerNice:        &containerNice,
+		ContainerOOMScoreAdj: &containerOOMScoreAdj,
+	}
+	if Conf.DockerNice != nil {
+		policy.DockerNice = Conf.DockerNice
+	}
+	if Conf.ContainerNice != nil {
+		policy.ContainerNice = Conf.ContainerNice
+	}
+	if Conf.DockerOOMScoreAdj != nil {
+		policy.DockerOOMScoreAdj = Conf.DockerOOMScoreAdj
+	}
+	if Conf.ContainerOOMScoreAdj != nil {
+		policy.ContainerOOMScoreAdj = Conf.ContainerOOMScoreAdj
+	}
+	return policy
+}
+
+func readOOMScoreAdj(pid int) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(procDir, strconv.Itoa(pid), "oom_score_adj"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func writeOOMScoreAdj(pid, score int) error {
+	return ioutil.WriteFile(path.Join(procDir, strconv.Itoa(pid), "oom_score_adj"), []byte(strconv.Itoa(score)), 0644)
+}
+
+// applyDockerPolicy sets the policy on the docker daemon itself
+func applyDockerPolicy(dockerPid int, policy ProcessPolicy) {
+	if policy.DockerNice != nil {
+		syscall.Setpriority(syscall.PRIO_PROCESS, dockerPid, *policy.DockerNice)
+	}
+	if policy.DockerOOMScoreAdj != nil {
+		if err := writeOOMScoreAdj(dockerPid, *policy.DockerOOMScoreAdj); err != nil {
+			Logger.Println("Cannot set docker oom_score_adj:", err)
+		}
+	}
+}
+
+// applyContainerPolicy sets the policy on the descendants of the docker
+// daemon which still have the values they inherited from it, so that
+// containers explicitly started with other values are left alone
+func applyContainerPolicy(tree *ProcessTree, policy ProcessPolicy) {
+	dockerOOMScoreAdj, oomErr := readOOMScoreAdj(tree.Pid)
+	for _, child := range tree.Descendants() {
+		if policy.ContainerNice != nil && policy.DockerNice != nil &&
+			child.Nice == *policy.DockerNice && child.Nice != *policy.ContainerNice {
+			syscall.Setpriority(syscall.PRIO_PROCESS, child.Pid, *policy.ContainerNice)
+		}
+		if policy.ContainerOOMScoreAdj != nil && oomErr == nil {
+			if score, err := readOOMScoreAdj(child.Pid); err == nil &&
+				score == dockerOOMScoreAdj && score != *policy.ContainerOOMScoreAdj {
+				writeOOMScoreAdj(child.Pid, *policy.ContainerOOMScoreAdj)
+			}
+		}
+	}
+}
+
+// manageDockerProcesses applies the process policy to docker and to its
+// descendants every ReniceSleepTime seconds, until exit is signaled
+func manageDockerProcesses(dockerPid int, exit chan int) {
+	policy := getProcessPolicy()
+	applyDockerPolicy(dockerPid, policy)
+	for {
+		procs, err := readProcesses(procDir)
+		if err != nil {
+			SendError(err, "Failed to read processes", nil)
+		} else if tree, err := buildProcessTree(procs, dockerPid); err == nil {
+			applyContainerPolicy(tree, policy)
+		}
+		select {
+		case <-exit:
+			return
+		case <-time.After(ReniceSleepTime * time.Second):
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func procStat(pid, ppid int, comm string, nice int) string {
+	return fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 100 0 0 0 1 2 0 0 20 %d 1 0 100 1000 10", pid, comm, ppid, pid, pid, nice)
+}
+
+func TestParseProcStat(t *testing.T) {
+	info, err := parseProcStat([]byte(procStat(42, 1, "my (odd) proc", -10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pid != 42 || info.PPid != 1 || info.Comm != "my (odd) proc" || info.Nice != -10 {
+		t.Fatalf("Unexpected process info: %+v", info)
+	}
+
+	if _, err := parseProcStat([]byte("42 (short) S 1")); err == nil {
+		t.Fatal("Expected error on truncated stat content")
+	}
+}
+
+func TestReadProcessTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proctree-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	procs := []struct {
+		pid, ppid, nice int
+		comm            string
+	}{
+		{1, 0, 0, "init"},
+		{100, 1, -10, "docker"},
+		{200, 100, -10, "docker-proxy"},
+		{300, 100, 0, "nginx"},
+		{301, 300, 0, "nginx"},
+		{400, 1, 0, "sshd"},
+	}
+	for _, p := range procs {
+		procPath := path.Join(dir, fmt.Sprint(p.pid))
+		if err := os.Mkdir(procPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(procPath, "stat"), []byte(procStat(p.pid, p.ppid, p.comm, p.nice)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(path.Join(dir, "self"), 0755)
+
+	infos, err := readProcesses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(procs) {
+		t.Fatalf("Expected %d processes, got %d", len(procs), len(infos))
+	}
+
+	tree, err := buildProcessTree(infos, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descendants := tree.Descendants()
+	if len(descendants) != 3 {
+		t.Fatalf("Expected 3 descendants, got %d", len(descendants))
+	}
+	for i, pid := range []int{200, 300, 301} {
+		if descendants[i].Pid != pid {
+			t.Errorf("Expected descendant %d, got %d", pid, descendants[i].Pid)
+		}
+	}
+	expected := "100 docker (nice -10)\n  200 docker-proxy (nice -10)\n  300 nginx (nice 0)\n    301 nginx (nice 0)\n"
+	if tree.String() != expected {
+		t.Fatalf("Unexpected tree:\n%s", tree)
+	}
+
+	if _, err := buildProcessTree(infos, 999); err == nil {
+		t.Fatal("Expected error for a missing root process")
+	}
+}
@@ -18,6 +18,9 @@ type RegResponseForm struct {
 	DockerBinaryURL string `json:"docker_url"`
 	NgrokBinaryURL  string `json:"ngrok_url"`
 	PublicIpAddress string `json:"public_ip"`
+
+	// nil when the response has no registry_credentials
+	RegistryCredentials []RegistryCredential `json:"registry_credentials"`
 }
 
 type RegPostForm struct {
@@ -41,6 +44,8 @@ type RegGetForm struct {
 	UserCaCert   string `json:"user_ca_cert"`
 	UUID         string `json:"uuid"`
 	NgrokHost    string `json:"ngrok_server_addr"`
+
+	RegistryCredentials []RegistryCredential `json:"registry_credentials"`
 }
 
 func PostToTutum(url, caFilePath, configFilePath string) error {
@@ -200,6 +205,7 @@ func handleRegResponse(body []byte, caFilePath, configFilePath string) error {
 	if responseForm.NgrokBinaryURL != "" {
 		NgrokBinaryURL = responseForm.NgrokBinaryURL
 	}
+	applyRegistryCredentials(responseForm.RegistryCredentials)
 	// Save to configuration file
 	if isModified {
 		Logger.Println("Updating configuration file...")
@@ -207,3 +213,105 @@ func handleRegResponse(body []byte, caFilePath, configFilePath string) error {
 	}
 	return nil
 }
+
+type DockerStatePatchForm struct {
+	DockerState string      `json:"docker_state"`
+	LastExit    *DockerExit `json:"docker_last_exit,omitempty"`
+	Version     string      `json:"agent_version"`
+}
+
+type DockerHealthPatchForm struct {
+	DockerHealth struct {
+		LastCheck time.Time    `json:"last_check"`
+		LatencyMs int64        `json:"latency_ms"`
+		Failures  int          `json:"failures"`
+		Error     string       `json:"error,omitempty"`
+		Cgroup    *CgroupUsage `json:"cgroup,omitempty"`
+	} `json:"docker_health"`
+	Version string `json:"agent_version"`
+}
+
+type PreflightPatchForm struct {
+	Preflight []PreflightResult `json:"preflight"`
+	Version   string            `json:"agent_version"`
+}
+
+type DockerUpgradePatchForm struct {
+	DockerUpgrade DockerUpgradeStatus `json:"docker_upgrade"`
+	Version       string              `json:"agent_version"`
+}
+
+// ReportDockerState lets Tutum know about the state of the docker daemon,
+// and how its last process terminated if it did
+func ReportDockerState(state DockerState, lastExit *DockerExit) {
+	form := DockerStatePatchForm{}
+	form.Version = VERSION
+	form.DockerState = state.String()
+	form.LastExit = lastExit
+	patchNode(form, "docker state")
+}
+
+// ReportDockerHealth lets Tutum know about the last docker health check
+func ReportDockerHealth(health DockerHealth) {
+	form := DockerHealthPatchForm{}
+	form.Version = VERSION
+	form.DockerHealth.LastCheck = health.LastCheck
+	form.DockerHealth.LatencyMs = int64(health.Latency / time.Millisecond)
+	form.DockerHealth.Failures = health.Failures
+	form.DockerHealth.Error = health.Error
+	form.DockerHealth.Cgroup = health.Cgroup
+	patchNode(form, "docker health")
+}
+
+// ReportPreflight lets Tutum know about the problems found on the host
+func ReportPreflight(results []PreflightResult) {
+	form := PreflightPatchForm{}
+	form.Version = VERSION
+	form.Preflight = results
+	patchNode(form, "preflight results")
+}
+
+// ReportDockerUpgrade lets Tutum know whether a docker upgrade is held
+// until the next maintenance window
+func ReportDockerUpgrade(status DockerUpgradeStatus) {
+	form := DockerUpgradePatchForm{}
+	form.Version = VERSION
+	form.DockerUpgrade = status
+	patchNode(form, "docker upgrade status")
+}
+
+// patchNode sends a partial update of the node to Tutum
+func patchNode(form interface{}, what string) {
+	if Conf.TutumUUID == "" || *FlagStandalone {
+		return
+	}
+	data, err := json.Marshal(form)
+	if err != nil {
+		SendError(err, "Json marshal error", nil)
+		Logger.Printf("Cannot marshal the %s form: %s", what, err)
+		return
+	}
+
+	url := utils.JoinURL(Conf.TutumHost, RegEndpoint)
+	if _, err = SendRequest("PATCH", utils.JoinURL(url, Conf.TutumUUID), data, nodeHeaders()); err != nil {
+		SendError(err, "Failed to patch "+what+" to Tutum", nil)
+		Logger.Printf("Failed to patch %s to Tutum, %s", what, err)
+	}
+}
+
+// postNode sends form to the endpoint of the node under path
+func postNode(path string, form interface{}) error {
+	data, err := json.Marshal(form)
+	if err != nil {
+		return err
+	}
+	url := utils.JoinURL(utils.JoinURL(utils.JoinURL(Conf.TutumHost, RegEndpoint), Conf.TutumUUID), path)
+	_, err = SendRequest("POST", url, data, nodeHeaders())
+	return err
+}
+
+func nodeHeaders() []string {
+	return []string{"Authorization TutumAgentToken " + Conf.TutumToken,
+		"Content-Type application/json",
+		"User-Agent tutum-agent/" + VERSION}
+}
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// RegistryCredential is a login to a private registry delivered by Tutum
+type RegistryCredential struct {
+	Registry string `json:"registry"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+var registryCredentialsMutex sync.Mutex
+
+// registryState records the registries whose login was written by the
+// agent, and the logins of the user they replaced, restored once Tutum no
+// longer delivers credentials for them
+type registryState struct {
+	Registries []string                   `json:"registries"`
+	Replaced   map[string]json.RawMessage `json:"replaced,omitempty"`
+}
+
+// SyncRegistryCredentials writes the credentials to the docker client
+// config of root, replacing the ones written before. Other logins of the
+// user are left untouched, and those replaced are restored afterwards.
+func SyncRegistryCredentials(creds []RegistryCredential) error {
+	return syncRegistryCredentials(DockerClientConfig, path.Join(TutumHome, RegistriesFileName), creds)
+}
+
+// RemoveRegistryCredentials removes the credentials written by the agent
+// from the docker client config, once the node is no longer registered
+func RemoveRegistryCredentials() {
+	if err := SyncRegistryCredentials(nil); err != nil {
+		SendError(err, "Failed to remove registry credentials", nil)
+		Logger.Println("Cannot remove registry credentials:", err)
+	}
+}
+
+// PollRegistryCredentials fetches the node from Tutum every
+// RegistryCredentialsSyncInterval seconds, forever, and keeps the registry
+// credentials in sync. They are removed when the node is unregistered.
+func PollRegistryCredentials(url string) {
+	for {
+		time.Sleep(RegistryCredentialsSyncInterval * time.Second)
+		body, err := SendRequest("GET", utils.JoinURL(url, Conf.TutumUUID), nil, nodeHeaders())
+		if err != nil {
+			if err.Error() == "404" || err.Error() == "401" {
+				Logger.Println("Node is no longer registered in Tutum, removing registry credentials")
+				RemoveRegistryCredentials()
+			} else if *FlagDebugMode {
+				Logger.Println("Cannot get registry credentials from Tutum:", err)
+			}
+			continue
+		}
+		var form RegGetForm
+		if err := json.Unmarshal(body, &form); err != nil {
+			Logger.Println("Cannot unmarshal the node info:", err)
+			continue
+		}
+		applyRegistryCredentials(form.RegistryCredentials)
+	}
+}
+
+// applyRegistryCredentials syncs the credentials of a Tutum response, if
+// it has any. A response without registry_credentials leaves them as is.
+func applyRegistryCredentials(creds []RegistryCredential) {
+	if creds == nil {
+		return
+	}
+	if err := SyncRegistryCredentials(creds); err != nil {
+		SendError(err, "Failed to write registry credentials", nil)
+		Logger.Println("Cannot write registry credentials:", err)
+	}
+}
+
+func syncRegistryCredentials(configFile, stateFile string, creds []RegistryCredential) error {
+	registryCredentialsMutex.Lock()
+	defer registryCredentialsMutex.Unlock()
+
+	config := map[string]json.RawMessage{}
+	if data, err := ioutil.ReadFile(configFile); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	auths := map[string]json.RawMessage{}
+	if data, ok := config["auths"]; ok {
+		if err := json.Unmarshal(data, &auths); err != nil {
+			return err
+		}
+	}
+	var state registryState
+	if data, err := ioutil.ReadFile(stateFile); err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	managed := map[string]bool{}
+	for _, registry := range state.Registries {
+		managed[registry] = true
+	}
+	replaced := map[string]json.RawMessage{}
+	for registry, auth := range state.Replaced {
+		replaced[registry] = auth
+	}
+
+	var registries []string
+	updated := map[string]json.RawMessage{}
+	for _, cred := range creds {
+		auth, err := json.Marshal(map[string]string{
+			"auth":  base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password)),
+			"email": cred.Email,
+		})
+		if err != nil {
+			return err
+		}
+		updated[cred.Registry] = auth
+		registries = append(registries, cred.Registry)
+	}
+	sort.Strings(registries)
+
+	changed := false
+	for _, registry := range state.Registries {
+		if _, ok := updated[registry]; ok {
+			continue
+		}
+		if auth, ok := replaced[registry]; ok {
+			Logger.Println("Restoring the previous credentials of registry", registry)
+			auths[registry] = auth
+			delete(replaced, registry)
+			changed = true
+		} else if _, ok := auths[registry]; ok {
+			Logger.Println("Removing the credentials of registry", registry)
+			delete(auths, registry)
+			changed = true
+		}
+	}
+	for registry, auth := range updated {
+		if current, ok := auths[registry]; ok && !managed[registry] {
+			replaced[registry] = current
+		}
+		if !sameJSON(auths[registry], auth) {
+			Logger.Println("Writing the credentials of registry", registry)
+			auths[registry] = auth
+			changed = true
+		}
+	}
+
+	// the state is written first, so that the replaced logins are never
+	// taken for the ones of the user
+	newState := registryState{Registries: registries}
+	if len(replaced) > 0 {
+		newState.Replaced = replaced
+	}
+	if len(state.Registries) == 0 {
+		state.Registries = nil
+	}
+	if !reflect.DeepEqual(newState, state) {
+		data, err := json.Marshal(newState)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(stateFile, data, 0600); err != nil {
+			return err
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	data, err := json.Marshal(auths)
+	if err != nil {
+		return err
+	}
+	config["auths"] = data
+	if data, err = json.MarshalIndent(config, "", "\t"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(configFile), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(configFile, data, 0600)
+}
+
+func sameJSON(a, b []byte) bool {
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return false
+	}
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// writeFileAtomic replaces file with data, never leaving it half written
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	// WriteFile keeps the permissions of an existing file
+	if err := os.Chmod(tmp, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func readClientAuths(t *testing.T, file string) map[string]map[string]string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Auths map[string]map[string]string
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	return config.Auths
+}
+
+func TestSyncRegistryCredentials(t *testing.T) {
+	Logger = log.New(ioutil.Discard, "", 0)
+	dir, err := ioutil.TempDir("", "registry-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, ".docker", "config.json")
+	stateFile := path.Join(dir, "registries.json")
+
+	// a login of the user is kept along with the other settings
+	os.MkdirAll(path.Dir(configFile), 0755)
+	ioutil.WriteFile(configFile, []byte(`{"auths":{"user.example.com":{"auth":"dXNlcjpwYXNz"}},"psFormat":"{{.ID}}"}`), 0644)
+
+	creds := []RegistryCredential{
+		{Registry: "a.example.com", Username: "alice", Password: "secret", Email: "alice@example.com"},
+		{Registry: "b.example.com", Username: "bob", Password: "hunter2"},
+	}
+	if err := syncRegistryCredentials(configFile, stateFile, creds); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected config.json to be private, got %s", info.Mode())
+	}
+	data, _ := ioutil.ReadFile(configFile)
+	var raw map[string]interface{}
+	json.Unmarshal(data, &raw)
+	if raw["psFormat"] != "{{.ID}}" {
+		t.Errorf("expected other settings to be kept, got %s", data)
+	}
+	auths := readClientAuths(t, configFile)
+	if auths["a.example.com"]["auth"] != "YWxpY2U6c2VjcmV0" || auths["a.example.com"]["email"] != "alice@example.com" ||
+		auths["b.example.com"]["auth"] != "Ym9iOmh1bnRlcjI=" || auths["user.example.com"]["auth"] != "dXNlcjpwYXNz" {
+		t.Errorf("unexpected auths %v", auths)
+	}
+
+	// credentials no longer delivered are removed, and changed ones updated
+	creds = []RegistryCredential{{Registry: "b.example.com", Username: "bob", Password: "changed"}}
+	if err := syncRegistryCredentials(configFile, stateFile, creds); err != nil {
+		t.Fatal(err)
+	}
+	auths = readClientAuths(t, configFile)
+	if _, ok := auths["a.example.com"]; ok || auths["b.example.com"]["auth"] != "Ym9iOmNoYW5nZWQ=" || auths["user.example.com"] == nil {
+		t.Errorf("unexpected auths %v", auths)
+	}
+
+	// unregistering removes all the credentials written by the agent
+	if err := syncRegistryCredentials(configFile, stateFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	auths = readClientAuths(t, configFile)
+	if len(auths) != 1 || auths["user.example.com"] == nil {
+		t.Errorf("expected only the user login to be left, got %v", auths)
+	}
+
+	// a login of the user replaced by Tutum is restored afterwards
+	creds = []RegistryCredential{{Registry: "user.example.com", Username: "tutum", Password: "token"}}
+	if err := syncRegistryCredentials(configFile, stateFile, creds); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncRegistryCredentials(configFile, stateFile, creds); err != nil {
+		t.Fatal(err)
+	}
+	if auths = readClientAuths(t, configFile); auths["user.example.com"]["auth"] != "dHV0dW06dG9rZW4=" {
+		t.Errorf("expected the Tutum login to be written, got %v", auths)
+	}
+	if err := syncRegistryCredentials(configFile, stateFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	if auths = readClientAuths(t, configFile); len(auths) != 1 || auths["user.example.com"]["auth"] != "dXNlcjpwYXNz" {
+		t.Errorf("expected the user login to be restored, got %v", auths)
+	}
+}
+
+func TestRedactResponseBody(t *testing.T) {
+	body := `{"uuid":"abc","registry_credentials":[{"registry":"a.example.com","username":"alice","password":"secret"}]}`
+	redacted := redactResponseBody([]byte(body))
+	if strings.Contains(redacted, "secret") || !strings.Contains(redacted, `"uuid":"abc"`) {
+		t.Errorf("expected the credentials to be redacted, got %s", redacted)
+	}
+	if other := `{"uuid":"abc"}`; redactResponseBody([]byte(other)) != other {
+		t.Error("expected bodies without credentials to be logged as is")
+	}
+}
@@ -3,8 +3,8 @@ package agent
 import (
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
-	"time"
 )
 
 func HandleSig() {
@@ -15,40 +15,29 @@ func HandleSig() {
 		for {
 			s := <-c
 			Logger.Println("Got signal:", s)
-			if s == os.Interrupt {
-				ScheduledShutdown = true
-				if DockerProcess == nil {
+			if s == syscall.SIGHUP {
+				Logger.Print("Sighup is ignored")
+				continue
+			}
+			if ScheduledShutdown {
+				continue
+			}
+			ScheduledShutdown = true
+			go func() {
+				if Docker == nil || Docker.State() == DockerStopped {
 					Logger.Println("Docker daemon is not running")
-					os.RemoveAll(TutumPidFile)
-					Logger.Fatal("Exiting agent")
 				} else {
-					Logger.Println("Docker daemon is running, sending SIGTERM")
-					ScheduleToTerminateDocker = true
-					DockerProcess.Signal(syscall.SIGTERM)
-				}
-				syscall.Kill(os.Getpid(), syscall.SIGTERM)
-			} else if s == syscall.SIGHUP {
-				Logger.Print("Sighup is ignored")
-			} else {
-				ScheduledShutdown = true
-				if DockerProcess != nil {
 					Logger.Println("Docker daemon is running")
+					if err := SnapshotContainers().Save(path.Join(TutumHome, ContainerSnapshotName)); err != nil {
+						Logger.Println("Cannot save the running containers:", err)
+					}
 					Logger.Println("Starting to shut down docker daemon gracefully")
-					ScheduleToTerminateDocker = true
-					DockerProcess.Signal(syscall.SIGTERM)
+					Docker.Stop()
 				}
-				go func() {
-					for {
-						if DockerProcess != nil {
-							time.Sleep(10 * time.Millisecond)
-						} else {
-							Logger.Println("Exiting agent")
-							os.RemoveAll(TutumPidFile)
-							os.Exit(130)
-						}
-					}
-				}()
-			}
+				Logger.Println("Exiting agent")
+				os.RemoveAll(TutumPidFile)
+				os.Exit(130)
+			}()
 		}
 	}()
 }
@@ -0,0 +1,435 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type DockerState int
+
+const (
+	DockerStopped DockerState = iota
+	DockerStarting
+	DockerRunning
+	DockerStopping
+	DockerCrashLoop
+)
+
+func (s DockerState) String() string {
+	switch s {
+	case DockerStopped:
+		return "stopped"
+	case DockerStarting:
+		return "starting"
+	case DockerRunning:
+		return "running"
+	case DockerStopping:
+		return "stopping"
+	case DockerCrashLoop:
+		return "crash_loop"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// How the docker daemon terminated
+const (
+	DockerExitStopped = "stopped"
+	DockerExitKilled  = "killed"
+	DockerExitCrashed = "crashed"
+)
+
+// DockerExit records the termination of a docker daemon process
+type DockerExit struct {
+	Pid   int       `json:"pid"`
+	Time  time.Time `json:"time"`
+	How   string    `json:"how"`
+	Error string    `json:"error,omitempty"`
+}
+
+// DockerSupervisor owns the docker daemon process. It restarts the daemon
+// with an exponential backoff when it dies, and gives up once the daemon
+// crashes CrashLoopCount times within CrashLoopWindow. The preflight checks
+// are run again after every crash, and the failing ones are added to the
+// crash reports. Stop escalates to SIGKILL when the daemon does not exit
+// within StopTimeout.
+type DockerSupervisor struct {
+	CrashLoopCount  int
+	CrashLoopWindow time.Duration
+	StopTimeout     time.Duration
+
+	mutex      sync.Mutex
+	state      DockerState
+	process    *os.Process
+	killed     bool
+	lastExit   *DockerExit
+	ready      chan struct{}
+	stopping   chan struct{}
+	done       chan struct{}
+	crashes    []time.Time
+	newCommand func() *exec.Cmd
+	preflight  func() []PreflightResult
+}
+
+// NewDockerSupervisor creates a supervisor running the docker binary found
+// at dockerBinPath, with start options computed on every (re)start
+func NewDockerSupervisor(dockerBinPath, keyFilePath, certFilePath, caFilePath string) *DockerSupervisor {
+	s := newSupervisor(func() *exec.Cmd {
+		bin, args := getDockerStartCommand(dockerBinPath, keyFilePath, certFilePath, caFilePath)
+		if len(DockerActivatedSockets) > 0 {
+			return dockerCgroupCommand(activatedCommand(DockerActivatedSockets, dockerEnv(dockerBinPath), bin, args...))
+		}
+		cmd := exec.Command(bin, args...)
+		cmd.Env = dockerEnv(dockerBinPath)
+		return dockerCgroupCommand(cmd)
+	})
+	if Conf.DockerCrashLoopCount > 0 {
+		s.CrashLoopCount = Conf.DockerCrashLoopCount
+	}
+	if Conf.DockerCrashLoopWindow > 0 {
+		s.CrashLoopWindow = time.Duration(Conf.DockerCrashLoopWindow) * time.Minute
+	}
+	if Conf.DockerStopTimeout > 0 {
+		s.StopTimeout = time.Duration(Conf.DockerStopTimeout) * time.Second
+	}
+	s.preflight = RunPreflight
+	return s
+}
+
+func newSupervisor(newCommand func() *exec.Cmd) *DockerSupervisor {
+	return &DockerSupervisor{
+		CrashLoopCount:  DockerCrashLoopCount,
+		CrashLoopWindow: DockerCrashLoopWindow * time.Minute,
+		StopTimeout:     DockerStopTimeout * time.Second,
+		state:           DockerStopped,
+		ready:           make(chan struct{}),
+		newCommand:      newCommand,
+	}
+}
+
+// State returns the current state of the docker daemon
+func (s *DockerSupervisor) State() DockerState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+// Pid returns the pid of the docker daemon, or 0 if it is not running
+func (s *DockerSupervisor) Pid() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.process == nil {
+		return 0
+	}
+	return s.process.Pid
+}
+
+// LastExit returns how the last docker daemon process terminated, or nil
+// if none did yet
+func (s *DockerSupervisor) LastExit() *DockerExit {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastExit
+}
+
+// Ready returns a channel closed once the docker daemon accepts connections
+func (s *DockerSupervisor) Ready() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ready
+}
+
+// WaitReady blocks until the docker daemon accepts connections, or until
+// timeout expires if it is not zero. It returns whether docker is ready.
+func (s *DockerSupervisor) WaitReady(timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	for {
+		select {
+		case <-s.Ready():
+			if s.State() == DockerRunning {
+				return true
+			}
+			// the daemon died right after being ready, wait for the next one
+			time.Sleep(100 * time.Millisecond)
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// Start launches the docker daemon, unless it is already running. Starting
+// a supervisor in crash loop state clears its crash history.
+func (s *DockerSupervisor) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch s.state {
+	case DockerStarting, DockerRunning:
+		return
+	case DockerStopping:
+		Logger.Println("Docker daemon is being stopped, cannot start it")
+		return
+	case DockerCrashLoop:
+		s.crashes = nil
+	}
+	s.state = DockerStarting
+	s.killed = false
+	s.stopping = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.supervise(s.stopping, s.done)
+}
+
+// Stop terminates the docker daemon and waits for it to exit, sending
+// SIGKILL if it is still running after StopTimeout. The daemon is not
+// restarted until Start is called again.
+func (s *DockerSupervisor) Stop() {
+	s.mutex.Lock()
+	if s.state == DockerStopped || s.state == DockerCrashLoop {
+		s.mutex.Unlock()
+		return
+	}
+	done := s.done
+	if s.state != DockerStopping {
+		s.state = DockerStopping
+		close(s.stopping)
+		if s.process != nil {
+			Logger.Printf("Sending SIGTERM to docker daemon (PID:%d)", s.process.Pid)
+			s.process.Signal(syscall.SIGTERM)
+		}
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(s.StopTimeout):
+	}
+
+	s.mutex.Lock()
+	if s.process != nil {
+		Logger.Printf("Docker daemon (PID:%d) did not stop within %s, sending SIGKILL", s.process.Pid, s.StopTimeout)
+		s.killed = true
+		s.process.Kill()
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(DockerKillTimeout * time.Second):
+		err := errors.New("docker daemon did not exit after SIGKILL")
+		SendError(err, "Failed to stop docker daemon", nil)
+		Logger.Println("Docker daemon did not exit after SIGKILL, giving up waiting for it")
+	}
+}
+
+func (s *DockerSupervisor) supervise(stopping, done chan struct{}) {
+	defer close(done)
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := s.run(s.newCommand(), stopping)
+
+		s.mutex.Lock()
+		s.recordExit(err)
+		s.process = nil
+		if s.state == DockerStopping {
+			s.state = DockerStopped
+			s.resetReady()
+			s.mutex.Unlock()
+			Logger.Println("Docker daemon stopped")
+			return
+		}
+		if s.state == DockerRunning {
+			s.resetReady()
+		}
+		if err == nil {
+			err = errors.New("docker daemon exited")
+		}
+		exit := s.lastExit
+		crashLoop := s.recordCrash(time.Now())
+		crashes := len(s.crashes)
+		if crashLoop {
+			s.state = DockerCrashLoop
+		} else {
+			s.state = DockerStarting
+		}
+		s.mutex.Unlock()
+
+		extra := s.crashReport(exit)
+		SendError(err, "Docker daemon terminates unexpectedly", extra)
+		if crashLoop {
+			s.reportCrashLoop(err, crashes, exit, extra)
+			return
+		}
+		go ReportDockerState(DockerStarting, exit)
+
+		if time.Since(started) > DockerBackoffResetTime*time.Second {
+			backoff = time.Second
+		}
+		Logger.Printf("Respawning docker daemon in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-stopping:
+		}
+		if backoff *= 2; backoff > MaxWaitingTime*time.Second {
+			backoff = MaxWaitingTime * time.Second
+		}
+
+		s.mutex.Lock()
+		if s.state == DockerStopping {
+			s.state = DockerStopped
+			s.mutex.Unlock()
+			Logger.Println("Docker daemon stopped")
+			return
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// recordExit records how the docker daemon terminated and cleans up the
+// files it left behind. It must be called with the mutex held.
+func (s *DockerSupervisor) recordExit(err error) {
+	if s.process == nil {
+		return
+	}
+	exit := &DockerExit{Pid: s.process.Pid, Time: time.Now(), How: DockerExitCrashed}
+	if s.state == DockerStopping {
+		exit.How = DockerExitStopped
+		if s.killed {
+			exit.How = DockerExitKilled
+		}
+	}
+	if err != nil {
+		exit.Error = err.Error()
+	}
+	s.lastExit = exit
+	Logger.Printf("Docker daemon (PID:%d) %s", exit.Pid, exit.How)
+	if exit.How != DockerExitStopped {
+		cleanupDockerFiles()
+	}
+}
+
+// recordCrash adds a crash to the history and reports whether the daemon is
+// crash looping. It must be called with the mutex held.
+func (s *DockerSupervisor) recordCrash(now time.Time) bool {
+	crashes := []time.Time{now}
+	for _, crash := range s.crashes {
+		if now.Sub(crash) < s.CrashLoopWindow {
+			crashes = append(crashes, crash)
+		}
+	}
+	s.crashes = crashes
+	return s.CrashLoopCount > 0 && len(s.crashes) >= s.CrashLoopCount
+}
+
+// crashReport collects the end of the docker log, how docker terminated and
+// the preflight checks which fail after a crash
+func (s *DockerSupervisor) crashReport(exit *DockerExit) map[string]interface{} {
+	extra := map[string]interface{}{}
+	if out := tailDockerLog(); out != "" {
+		extra["docker-log"] = out
+		Logger.Printf("\n=======DOCKER LOGS BEGIN========\n%s=======DOCKER LOGS END========\n", out)
+	}
+	if exit != nil {
+		extra["docker-last-exit"] = *exit
+	}
+	if s.preflight != nil {
+		var problems []PreflightResult
+		for _, result := range s.preflight() {
+			if result.Status != PreflightOK {
+				problems = append(problems, result)
+			}
+		}
+		if len(problems) > 0 {
+			extra["preflight"] = problems
+		}
+	}
+	return extra
+}
+
+func (s *DockerSupervisor) reportCrashLoop(err error, crashes int, exit *DockerExit, extra map[string]interface{}) {
+	msg := fmt.Sprintf("Docker daemon crashed %d times in %s, giving up restarting it", crashes, s.CrashLoopWindow)
+	Logger.Println(msg)
+	SendError(err, msg, extra)
+	ReportDockerState(DockerCrashLoop, exit)
+}
+
+// resetReady replaces the closed ready channel. It must be called with the
+// mutex held.
+func (s *DockerSupervisor) resetReady() {
+	select {
+	case <-s.ready:
+		s.ready = make(chan struct{})
+	default:
+	}
+}
+
+func (s *DockerSupervisor) setRunning(process *os.Process) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state == DockerStarting && s.process == process {
+		s.state = DockerRunning
+		close(s.ready)
+		Logger.Println("Docker daemon is ready")
+	}
+}
+
+// run starts the docker daemon and blocks until it exits
+func (s *DockerSupervisor) run(cmd *exec.Cmd, stopping chan struct{}) error {
+	unixsock := strings.TrimPrefix(DockerDefaultHost, "unix://")
+	exited := make(chan struct{})
+	var wg sync.WaitGroup
+
+	err := runDocker(cmd, func(process *os.Process) {
+		s.mutex.Lock()
+		s.process = process
+		if s.state == DockerStopping {
+			process.Signal(syscall.SIGTERM)
+		}
+		s.mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.waitSocket(process, unixsock, exited, stopping)
+		}()
+	})
+	close(exited)
+	wg.Wait()
+	return err
+}
+
+// waitSocket marks the daemon as running once its unix socket accepts
+// connections. Connections to a socket-activated socket are accepted before
+// docker serves them, so docker must answer /_ping instead.
+func (s *DockerSupervisor) waitSocket(process *os.Process, unixsock string, exited, stopping chan struct{}) {
+	for {
+		var err error
+		if len(DockerActivatedSockets) > 0 {
+			err = pingDocker(DialTimeOut * time.Second)
+		} else {
+			var conn net.Conn
+			if conn, err = net.DialTimeout("unix", unixsock, DialTimeOut*time.Second); err == nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			s.setRunning(process)
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-stopping:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
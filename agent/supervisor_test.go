@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func setupSupervisorTest(t *testing.T) (string, func()) {
+	if Logger == nil {
+		Logger = log.New(ioutil.Discard, "", 0)
+	}
+	dir, err := ioutil.TempDir("", "supervisor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLogDir, oldHost, oldPidFile := LogDir, DockerDefaultHost, DockerPidFile
+	LogDir = dir
+	DockerDefaultHost = "unix://" + path.Join(dir, "docker.sock")
+	DockerPidFile = path.Join(dir, "docker.pid")
+	return dir, func() {
+		LogDir, DockerDefaultHost, DockerPidFile = oldLogDir, oldHost, oldPidFile
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSupervisorStartStop(t *testing.T) {
+	dir, cleanup := setupSupervisorTest(t)
+	defer cleanup()
+
+	l, err := net.Listen("unix", path.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s := newSupervisor(func() *exec.Cmd { return exec.Command("sleep", "60") })
+	s.Start()
+	if !s.WaitReady(5 * time.Second) {
+		t.Fatal("Expected docker to be ready, state:", s.State())
+	}
+	if s.Pid() == 0 {
+		t.Fatal("Expected a docker pid")
+	}
+
+	s.Stop()
+	if s.State() != DockerStopped {
+		t.Fatal("Expected stopped state, got", s.State())
+	}
+	if s.Pid() != 0 {
+		t.Fatal("Expected no docker pid after stop")
+	}
+	select {
+	case <-s.Ready():
+		t.Fatal("Expected ready channel to be reset after stop")
+	default:
+	}
+}
+
+func TestSupervisorStopTimeout(t *testing.T) {
+	_, cleanup := setupSupervisorTest(t)
+	defer cleanup()
+
+	s := newSupervisor(func() *exec.Cmd {
+		return exec.Command("sh", "-c", "trap '' TERM; exec sleep 60")
+	})
+	s.StopTimeout = 500 * time.Millisecond
+	s.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not escalate to SIGKILL")
+	}
+	exit := s.LastExit()
+	if exit == nil || exit.How != DockerExitKilled {
+		t.Fatalf("Expected docker to be killed, got %+v", exit)
+	}
+}
+
+func TestSupervisorCleanupAfterCrash(t *testing.T) {
+	dir, cleanup := setupSupervisorTest(t)
+	defer cleanup()
+
+	pidFile := path.Join(dir, "docker.pid")
+	s := newSupervisor(func() *exec.Cmd {
+		return exec.Command("sh", "-c", "echo 999999 > "+pidFile+"; exit 1")
+	})
+	s.Start()
+	time.Sleep(500 * time.Millisecond)
+	s.Stop()
+
+	exit := s.LastExit()
+	if exit == nil || exit.How != DockerExitCrashed {
+		t.Fatalf("Expected docker to have crashed, got %+v", exit)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Fatal("Expected stale docker pid file to be removed")
+	}
+}
+
+func TestSupervisorCrashLoop(t *testing.T) {
+	_, cleanup := setupSupervisorTest(t)
+	defer cleanup()
+
+	starts, checks := 0, 0
+	s := newSupervisor(func() *exec.Cmd {
+		starts++
+		return exec.Command("false")
+	})
+	s.preflight = func() []PreflightResult {
+		checks++
+		return []PreflightResult{preflightOK("kernel", "3.10"), preflightFailure("disk", "no space left")}
+	}
+	s.CrashLoopCount = 3
+	s.CrashLoopWindow = time.Minute
+	s.Start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.State() != DockerCrashLoop {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected crash loop, state:", s.State())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	<-s.done
+	if starts != 3 {
+		t.Fatal("Expected 3 starts before giving up, got", starts)
+	}
+	if checks != 3 {
+		t.Fatal("Expected the preflight checks to run after each crash, got", checks)
+	}
+	if problems, _ := s.crashReport(nil)["preflight"].([]PreflightResult); len(problems) != 1 || problems[0].Check != "disk" {
+		t.Fatalf("Expected the failing check in the crash report, got %v", problems)
+	}
+	if s.WaitReady(100 * time.Millisecond) {
+		t.Fatal("Expected docker not to be ready")
+	}
+}
+
+func TestSupervisorStopDuringBackoff(t *testing.T) {
+	_, cleanup := setupSupervisorTest(t)
+	defer cleanup()
+
+	s := newSupervisor(func() *exec.Cmd { return exec.Command("false") })
+	s.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not interrupt the restart backoff")
+	}
+	if s.State() != DockerStopped {
+		t.Fatal("Expected stopped state, got", s.State())
+	}
+}
+
+func TestRecordCrash(t *testing.T) {
+	s := newSupervisor(nil)
+	s.CrashLoopCount = 3
+	s.CrashLoopWindow = 10 * time.Minute
+
+	now := time.Now()
+	if s.recordCrash(now.Add(-30 * time.Minute)) {
+		t.Fatal("Unexpected crash loop after one crash")
+	}
+	if s.recordCrash(now.Add(-5 * time.Minute)) {
+		t.Fatal("Unexpected crash loop, the first crash is outside the window")
+	}
+	if s.recordCrash(now) {
+		t.Fatal("Unexpected crash loop with two crashes in the window")
+	}
+	if !s.recordCrash(now.Add(time.Second)) {
+		t.Fatal("Expected crash loop with three crashes in the window")
+	}
+}
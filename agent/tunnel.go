@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"strings"
@@ -183,19 +182,7 @@ func isNodeReachable(url, uuid string) bool {
 
 	//waiting for docker port opens
 	Logger.Print("Waiting for docker unix socket to be ready")
-	for {
-		unixsock := DockerDefaultHost
-		if strings.HasPrefix(unixsock, "unix://") {
-			unixsock = DockerDefaultHost[7:]
-		}
-
-		_, err := net.DialTimeout("unix", unixsock, DialTimeOut*time.Second)
-		if err == nil {
-			break
-		} else {
-			time.Sleep(2 * time.Second)
-		}
-	}
+	WaitDockerReady()
 	Logger.Print("Docker unix socket opened")
 
 	//check the port from tutum server
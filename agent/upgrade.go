@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/tutumcloud/tutum-agent/utils"
+)
+
+// PollDockerUpgrades checks DockerBinaryURL for new docker versions, forever,
+// and stages them for UpdateDocker
+func PollDockerUpgrades(dockerBinPath, dockerNewBinPath, dockerNewBinSigPath string) {
+	for {
+		interval := DockerUpgradeCheckInterval
+		if Conf.DockerUpgradeCheckInterval > 0 {
+			interval = Conf.DockerUpgradeCheckInterval
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		if utils.FileExist(dockerNewBinPath) {
+			continue
+		}
+		def, err := getTargetDef(DockerBinaryURL)
+		if err != nil {
+			Logger.Println("Cannot check for docker upgrades:", err)
+			continue
+		}
+		running := getDockerVersion(dockerBinPath)
+		upgrade, err := dockerUpgradeAvailable(def.Version, running, Conf.DockerVersion)
+		if err != nil {
+			SendError(err, "Invalid docker version in the manifest", nil)
+			Logger.Println("Cannot check for docker upgrades:", err)
+			continue
+		}
+		if !upgrade {
+			continue
+		}
+		Logger.Printf("Docker %s is available (running %s), downloading it", def.Version, running)
+		if err := stageDockerUpgrade(def, dockerNewBinPath, dockerNewBinSigPath); err != nil {
+			SendError(err, "Failed to stage docker upgrade", map[string]interface{}{"version": def.Version})
+			Logger.Println("Cannot stage the docker upgrade:", err)
+			continue
+		}
+		Logger.Printf("Docker %s staged at %s", def.Version, dockerNewBinPath)
+	}
+}
+
+// dockerUpgradeAvailable reports whether the manifest version should replace
+// the running one. Pinned agents only move to the pinned version, newer or
+// not; others only move to newer versions.
+func dockerUpgradeAvailable(manifestVersion string, running semver.Version, pinned string) (bool, error) {
+	target, err := parseDockerVersion(manifestVersion)
+	if err != nil {
+		return false, err
+	}
+	if pinned != "" {
+		pin, err := parseDockerVersion(pinned)
+		if err != nil {
+			return false, err
+		}
+		return target.Equals(pin) && !running.Equals(pin), nil
+	}
+	return target.GT(running), nil
+}
+
+// stageDockerUpgrade downloads the build of def, checks its checksums and
+// signature, and only then moves it to dockerNewBinPath, which triggers
+// UpdateDocker
+func stageDockerUpgrade(def *TargetDef, dockerNewBinPath, dockerNewBinSigPath string) error {
+	if def.Signature_url == "" {
+		return errors.New("no signature_url in the docker manifest")
+	}
+	data, sig, err := getSignedTarget(def)
+	if err != nil {
+		return err
+	}
+
+	downloadPath := dockerNewBinPath + ".download"
+	defer os.RemoveAll(downloadPath)
+	if err := ioutil.WriteFile(downloadPath, data, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dockerNewBinSigPath, sig, 0644); err != nil {
+		return err
+	}
+	return os.Rename(downloadPath, dockerNewBinPath)
+}
@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestDockerUpgradeAvailable(t *testing.T) {
+	tests := []struct {
+		manifest string
+		running  string
+		pinned   string
+		expected bool
+	}{
+		{"1.10.3", "1.9.1", "", true},
+		{"1.10.3", "1.10.3", "", false},
+		{"1.9.1", "1.10.3", "", false},
+		{"17.05.0-ce", "1.13.1", "", true},
+		{"1.10.3", "1.9.1", "1.9.1", false},
+		{"1.10.3", "1.9.1", "1.10.3", true},
+		{"1.9.1", "1.10.3", "1.9.1", true},
+		{"1.10.3", "1.10.3", "1.10.3", false},
+	}
+	for _, test := range tests {
+		available, err := dockerUpgradeAvailable(test.manifest, mustVersion(test.running), test.pinned)
+		if err != nil || available != test.expected {
+			t.Errorf("%s running %s pinned to %q: expected %v, got %v (%v)", test.manifest, test.running, test.pinned, test.expected, available, err)
+		}
+	}
+	if _, err := dockerUpgradeAvailable("latest", mustVersion("1.9.1"), ""); err == nil {
+		t.Error("Expected an invalid manifest version to be rejected")
+	}
+}
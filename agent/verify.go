@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// SignatureInfo describes a verified detached signature
+type SignatureInfo struct {
+	KeyID  uint64
+	Signer string
+	Time   time.Time
+}
+
+func (s SignatureInfo) String() string {
+	return fmt.Sprintf("key %016X (%s), signed on %s", s.KeyID, s.Signer, s.Time.UTC().Format(time.RFC3339))
+}
+
+// LoadKeyring returns the keys trusted to sign downloaded artifacts: the
+// embedded Tutum key, or the one of the gpg keyring of root if none is
+// embedded, and the keys in Conf.ExtraKeyring if set
+func LoadKeyring() (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	if tutumKeyring != "" {
+		keys, err := readKeyring([]byte(tutumKeyring))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the embedded keyring: %s", err)
+		}
+		keyring = append(keyring, keys...)
+	} else if keys, err := loadSystemTutumKey(); err != nil {
+		Logger.Println("Cannot read the Tutum key from the gpg keyring:", err)
+	} else {
+		keyring = append(keyring, keys...)
+	}
+	if Conf.ExtraKeyring != "" {
+		data, err := ioutil.ReadFile(Conf.ExtraKeyring)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := readKeyring(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %s", Conf.ExtraKeyring, err)
+		}
+		keyring = append(keyring, keys...)
+	}
+	if len(keyring) == 0 {
+		return nil, errors.New("no trusted keys")
+	}
+	return keyring, nil
+}
+
+// readKeyring reads armored or binary public keys
+func readKeyring(data []byte) (openpgp.EntityList, error) {
+	if isArmored(data) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+func isArmored(data []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(data)), "-----BEGIN PGP")
+}
+
+// VerifySignature checks the armored or binary detached signature sig of
+// data against keyring
+func VerifySignature(keyring openpgp.EntityList, data, sig []byte) (*SignatureInfo, error) {
+	if isArmored(sig) {
+		block, err := armor.Decode(bytes.NewReader(sig))
+		if err != nil {
+			return nil, err
+		}
+		if sig, err = ioutil.ReadAll(block.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	var info SignatureInfo
+	p, err := packet.Read(bytes.NewReader(sig))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	switch s := p.(type) {
+	case *packet.Signature:
+		if s.IssuerKeyId != nil {
+			info.KeyID = *s.IssuerKeyId
+		}
+		info.Time = s.CreationTime
+	case *packet.SignatureV3:
+		info.KeyID = s.IssuerKeyId
+		info.Time = s.CreationTime
+	default:
+		return nil, errors.New("invalid signature: not a signature packet")
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	if err != nil {
+		return &info, err
+	}
+	for name := range signer.Identities {
+		info.Signer = name
+		break
+	}
+	return &info, nil
+}
+
+// verifyArtifact checks the signature of a downloaded artifact against the
+// trusted keys, logging and reporting the result
+func verifyArtifact(name string, data, sig []byte) error {
+	keyring, err := LoadKeyring()
+	if err == nil {
+		var info *SignatureInfo
+		info, err = VerifySignature(keyring, data, sig)
+		if err == nil {
+			Logger.Printf("Signature of %s verified: %s", name, info)
+			return nil
+		}
+		if info != nil {
+			err = fmt.Errorf("%s (%s)", err, info)
+		}
+	}
+	SendError(err, "Signature verification failed", map[string]interface{}{"artifact": name})
+	Logger.Printf("Signature verification of %s failed: %s", name, err)
+	return err
+}
+
+// verifyFileSignature checks the detached signature sigPath of file
+func verifyFileSignature(name, file, sigPath string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	return verifyArtifact(name, data, sig)
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func TestVerifySignature(t *testing.T) {
+	signer := newTestEntity(t, "signer")
+	other := newTestEntity(t, "other")
+	data := []byte("docker binary")
+
+	var sig, armoredSig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := openpgp.ArmoredDetachSign(&armoredSig, signer, bytes.NewReader(data), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := openpgp.EntityList{other, signer}
+	for _, s := range [][]byte{sig.Bytes(), armoredSig.Bytes()} {
+		info, err := VerifySignature(keyring, data, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.KeyID != signer.PrimaryKey.KeyId || info.Signer != "signer <signer@example.com>" || info.Time.IsZero() {
+			t.Fatal("Unexpected signature info:", info)
+		}
+	}
+
+	if _, err := VerifySignature(openpgp.EntityList{other}, data, sig.Bytes()); err == nil {
+		t.Error("Expected a signature from an untrusted key to be rejected")
+	}
+	if _, err := VerifySignature(keyring, []byte("tampered"), sig.Bytes()); err == nil {
+		t.Error("Expected tampered data to be rejected")
+	}
+	if _, err := VerifySignature(keyring, data, []byte("garbage")); err == nil {
+		t.Error("Expected an invalid signature to be rejected")
+	}
+}
+
+func TestVerifyFileSignatureWithExtraKeyring(t *testing.T) {
+	Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	dir, err := ioutil.TempDir("", "verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer := newTestEntity(t, "signer")
+	var keyring bytes.Buffer
+	if err := signer.Serialize(&keyring); err != nil {
+		t.Fatal(err)
+	}
+	keyringPath := path.Join(dir, "keyring.gpg")
+	if err := ioutil.WriteFile(keyringPath, keyring.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(dir, "docker")
+	sigPath := path.Join(dir, "docker.sig")
+	if err := ioutil.WriteFile(file, []byte("docker binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader([]byte("docker binary")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sigPath, sig.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConf := Conf
+	defer func() { Conf = oldConf }()
+	Conf.ExtraKeyring = keyringPath
+	if err := verifyFileSignature("docker", file, sigPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeyringFallsBackToGpg(t *testing.T) {
+	if tutumKeyring != "" {
+		t.Skip("the Tutum key is embedded")
+	}
+	Logger = log.New(ioutil.Discard, "", 0)
+	oldConf, oldExport := Conf, exportSystemTutumKey
+	defer func() { Conf, exportSystemTutumKey = oldConf, oldExport }()
+	Conf = Configuration{}
+
+	signer := newTestEntity(t, "signer")
+	var key bytes.Buffer
+	if err := signer.Serialize(&key); err != nil {
+		t.Fatal(err)
+	}
+	exportSystemTutumKey = func() ([]byte, error) { return key.Bytes(), nil }
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring) != 1 || keyring[0].PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Fatal("Expected the key of the gpg keyring to be trusted")
+	}
+
+	// gpg --export succeeds without output when the key was not imported
+	exportSystemTutumKey = func() ([]byte, error) { return nil, nil }
+	if _, err := LoadKeyring(); err == nil {
+		t.Fatal("Expected no trusted keys")
+	}
+}
@@ -0,0 +1,35 @@
+#!/bin/bash
+#
+# Updates the Tutum public key committed in agent/keyring.go. The key is
+# only written if its fingerprint matches GPG_KEY_TUTUM_ID.
+#
+set -e
+
+GPG_KEY_TUTUM_ID=${GPG_KEY_TUTUM_ID:-A87A2270}
+GPG_KEY_TUTUM_URL=${GPG_KEY_TUTUM_URL:-https://files.tutum.co/keys/$GPG_KEY_TUTUM_ID.pub}
+DEST=${1:-agent/keyring.go}
+
+KEY=$(curl -Ls --retry 30 --retry-delay 10 $GPG_KEY_TUTUM_URL)
+if [[ "$KEY" != "-----BEGIN PGP PUBLIC KEY BLOCK-----"* ]]; then
+	echo "Cannot download the public key $GPG_KEY_TUTUM_ID from $GPG_KEY_TUTUM_URL" >&2
+	exit 1
+fi
+
+export GNUPGHOME=$(mktemp -d)
+trap "rm -rf $GNUPGHOME" EXIT
+FINGERPRINTS=$(echo "$KEY" | gpg --batch --with-colons --import-options show-only --import 2>/dev/null | awk -F: '$1 == "fpr" { print $10 }')
+if [ "$(echo "$FINGERPRINTS" | head -n 1 | tail -c 9)" != "$GPG_KEY_TUTUM_ID" ]; then
+	echo "The key downloaded from $GPG_KEY_TUTUM_URL is not $GPG_KEY_TUTUM_ID:" $FINGERPRINTS >&2
+	exit 1
+fi
+
+cat > $DEST <<EOM
+package agent
+
+// tutumKeyring is the armored public key ($GPG_KEY_TUTUM_ID) trusted to sign the
+// artifacts downloaded by the agent. It is updated with contrib/make-keyring.sh,
+// which checks the fingerprint of the key.
+const tutumKeyring = \`$KEY
+\`
+EOM
+gofmt -w $DEST
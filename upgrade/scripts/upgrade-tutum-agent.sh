@@ -79,7 +79,6 @@ else
     echo "=> tutum-agent is upgraded from ${OLD_AGENT_VERSION} to ${NEW_AGENT_VERSION}"
     if [ -n "${AGENT_PID}" ]; then
         echo "=> killing the current tutum-agent process, and it will be restarted by upstart/systemd/sysmvinit"
-        echo "=> NOTICE: you might have to restart your stopped containers if they are launched without autorestart option"
         kill ${AGENT_PID}
     else
         echo "=> Please restart tutum-agent to apply the changes"